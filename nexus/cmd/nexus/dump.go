@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/wandb/wandb/nexus/internal/nexuslib"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/server"
+)
+
+// recordStats is the number of records, bytes and read errors of a record type
+type recordStats struct {
+	records int
+	bytes   int
+	errors  int
+}
+
+const (
+	// unknownRecordType is the type of the records that were read whole
+	// but whose type can't be decoded
+	unknownRecordType = "unknown"
+
+	// corruptRecordType is the type of the records whose chunks are
+	// corrupted, like the ones failing their CRC
+	corruptRecordType = "corrupt"
+)
+
+// dumpMain implements `nexus dump [flags] <file.wandb>`, printing the
+// records of a transaction log as json, one record per line
+func dumpMain(args []string) int {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	types := flags.String("type", "", "comma separated record types to print, e.g. history,summary,config,output_raw,stats,exit")
+	minStep := flags.Int64("min-step", 0, "only print history records from this step on")
+	maxStep := flags.Int64("max-step", math.MaxInt64, "only print history records up to this step")
+	stats := flags.Bool("stats", false, "print the number of records, bytes and read errors per record type instead")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: nexus dump [flags] <file.wandb>\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	typeFilter := make(map[string]bool)
+	for _, t := range strings.Split(*types, ",") {
+		if t != "" {
+			typeFilter[t] = true
+		}
+	}
+
+	logger := observability.NewNexusLogger(server.SetupDefaultLogger(), nil)
+	store := server.NewStore(context.Background(), flags.Arg(0), logger)
+	if err := store.Open(os.O_RDONLY); err != nil {
+		fmt.Fprintf(os.Stderr, "nexus dump: %s\n", err)
+		return 1
+	}
+	defer func() {
+		_ = store.Close()
+	}()
+
+	counts := make(map[string]*recordStats)
+	countsOf := func(recordType string) *recordStats {
+		if counts[recordType] == nil {
+			counts[recordType] = &recordStats{}
+		}
+		return counts[recordType]
+	}
+	for {
+		// the bytes of a record are what it takes in the log, framing included
+		offset := store.Offset()
+		record, err := store.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		size := int(store.Offset() - offset)
+		if err != nil {
+			// records that were read whole can still tell their type,
+			// corrupted chunks can't
+			recordType := unknownRecordType
+			var recordErr *server.RecordError
+			var chunkErr *server.ChunkError
+			switch {
+			case errors.As(err, &chunkErr):
+				recordType = corruptRecordType
+			case errors.As(err, &recordErr):
+				if name := nexuslib.RecordTypeNameFromBytes(recordErr.Data); name != "" {
+					recordType = name
+				}
+			}
+			if recordType == unknownRecordType || recordType == corruptRecordType ||
+				len(typeFilter) == 0 || typeFilter[recordType] {
+				if *stats {
+					c := countsOf(recordType)
+					c.errors++
+					c.bytes += size
+				} else {
+					fmt.Fprintf(os.Stderr, "nexus dump: error reading %s record: %s\n", recordType, err)
+				}
+			}
+			store.Recover()
+			continue
+		}
+
+		recordType := nexuslib.RecordTypeName(record)
+		if len(typeFilter) > 0 && !typeFilter[recordType] {
+			continue
+		}
+		// records without a step are not affected by the step range
+		if history := record.GetHistory(); history != nil {
+			step := history.GetStep().GetNum()
+			if step < *minStep || step > *maxStep {
+				continue
+			}
+		}
+
+		if *stats {
+			c := countsOf(recordType)
+			c.records++
+			c.bytes += size
+			continue
+		}
+
+		line, err := protojson.Marshal(record)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "nexus dump: error marshaling record: %s\n", err)
+			continue
+		}
+		fmt.Println(string(line))
+	}
+
+	if *stats {
+		printStats(counts)
+	}
+	return 0
+}
+
+// printStats prints a table of the record statistics, sorted by record type
+func printStats(counts map[string]*recordStats) {
+	recordTypes := make([]string, 0, len(counts))
+	for recordType := range counts {
+		recordTypes = append(recordTypes, recordType)
+	}
+	sort.Strings(recordTypes)
+
+	total := recordStats{}
+	fmt.Printf("%-20s %10s %14s %8s\n", "TYPE", "RECORDS", "BYTES", "ERRORS")
+	for _, recordType := range recordTypes {
+		c := counts[recordType]
+		fmt.Printf("%-20s %10d %14d %8d\n", recordType, c.records, c.bytes, c.errors)
+		total.records += c.records
+		total.bytes += c.bytes
+		total.errors += c.errors
+	}
+	fmt.Printf("%-20s %10d %14d %8d\n", "total", total.records, total.bytes, total.errors)
+}
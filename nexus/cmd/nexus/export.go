@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/server"
+)
+
+// exportMain implements `nexus export [flags] <file.wandb>`, writing the
+// run files of a transaction log to a local directory
+func exportMain(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := flags.String("dir", ".", "directory to write the run files to")
+	csv := flags.Bool("csv", false, "also write the history as csv with a column per key")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: nexus export [flags] <file.wandb>\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	logger := observability.NewNexusLogger(server.SetupDefaultLogger(), nil)
+	exporter := server.NewExporter(context.Background(), flags.Arg(0), *dir, *csv, logger)
+	if err := exporter.Do(); err != nil {
+		fmt.Fprintf(os.Stderr, "nexus export: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -22,6 +22,17 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sync":
+			os.Exit(syncMain(os.Args[2:]))
+		case "dump":
+			os.Exit(dumpMain(os.Args[2:]))
+		case "export":
+			os.Exit(exportMain(os.Args[2:]))
+		}
+	}
+
 	portFilename := flag.String(
 		"port-filename",
 		"port_file.txt",
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/wandb/wandb/nexus/pkg/auth"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/server"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+// syncMain implements `nexus sync [flags] <file.wandb>`, uploading a run
+// that was recorded offline
+func syncMain(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	baseUrl := flags.String("base-url", os.Getenv("WANDB_BASE_URL"), "W&B server url")
+	apiKey := flags.String("api-key", os.Getenv("WANDB_API_KEY"), "W&B api key")
+	entity := flags.String("entity", os.Getenv("WANDB_ENTITY"), "override the entity of the run")
+	project := flags.String("project", os.Getenv("WANDB_PROJECT"), "override the project of the run")
+	filesDir := flags.String("files-dir", "", "run files directory (default: files next to the log)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: nexus sync [flags] <file.wandb>\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	syncFile := flags.Arg(0)
+
+	if *baseUrl == "" {
+		*baseUrl = "https://api.wandb.ai"
+	}
+	if *apiKey == "" {
+		u, err := url.Parse(*baseUrl)
+		if err == nil {
+			_, *apiKey, _ = auth.GetNetrcLogin(u.Hostname())
+		}
+	}
+	if *apiKey == "" {
+		fmt.Fprintln(os.Stderr, "nexus sync: no api key, set WANDB_API_KEY or pass --api-key")
+		return 1
+	}
+	if *filesDir == "" {
+		*filesDir = filepath.Join(filepath.Dir(syncFile), "files")
+	}
+
+	settings := &service.Settings{
+		BaseUrl:  &wrapperspb.StringValue{Value: *baseUrl},
+		ApiKey:   &wrapperspb.StringValue{Value: *apiKey},
+		SyncFile: &wrapperspb.StringValue{Value: syncFile},
+		FilesDir: &wrapperspb.StringValue{Value: *filesDir},
+		Entity:   &wrapperspb.StringValue{Value: *entity},
+		Project:  &wrapperspb.StringValue{Value: *project},
+	}
+
+	logger := observability.NewNexusLogger(server.SetupDefaultLogger(), nil)
+	syncer := server.NewSyncer(context.Background(), settings, logger)
+	if err := syncer.Do(); err != nil {
+		fmt.Fprintf(os.Stderr, "nexus sync: %s\n", err)
+		return 1
+	}
+	fmt.Printf("nexus sync: synced %s\n", syncFile)
+	return 0
+}
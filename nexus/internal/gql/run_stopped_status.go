@@ -0,0 +1,93 @@
+package gql
+
+// The RunStoppedStatus query of api/graphql/query_run_stopped_status.graphql
+// is written by hand, in the shape genqlient generates, because the schema
+// isn't checked in to generate it. Delete this file once gql_gen.go is
+// regenerated with it.
+
+import (
+	"context"
+
+	"github.com/Khan/genqlient/graphql"
+)
+
+// RunStoppedStatusProject includes the requested fields of the GraphQL type Project.
+type RunStoppedStatusProject struct {
+	Run *RunStoppedStatusProjectRun `json:"run"`
+}
+
+// GetRun returns RunStoppedStatusProject.Run, and is useful for accessing the field via an interface.
+func (v *RunStoppedStatusProject) GetRun() *RunStoppedStatusProjectRun { return v.Run }
+
+// RunStoppedStatusProjectRun includes the requested fields of the GraphQL type Run.
+type RunStoppedStatusProjectRun struct {
+	Stopped *bool `json:"stopped"`
+}
+
+// GetStopped returns RunStoppedStatusProjectRun.Stopped, and is useful for accessing the field via an interface.
+func (v *RunStoppedStatusProjectRun) GetStopped() *bool { return v.Stopped }
+
+// RunStoppedStatusResponse is returned by RunStoppedStatus on success.
+type RunStoppedStatusResponse struct {
+	Project *RunStoppedStatusProject `json:"project"`
+}
+
+// GetProject returns RunStoppedStatusResponse.Project, and is useful for accessing the field via an interface.
+func (v *RunStoppedStatusResponse) GetProject() *RunStoppedStatusProject { return v.Project }
+
+// __RunStoppedStatusInput is the variables of RunStoppedStatus
+type __RunStoppedStatusInput struct {
+	EntityName  *string `json:"entityName"`
+	ProjectName *string `json:"projectName"`
+	RunId       string  `json:"runId"`
+}
+
+// GetEntityName returns __RunStoppedStatusInput.EntityName, and is useful for accessing the field via an interface.
+func (v *__RunStoppedStatusInput) GetEntityName() *string { return v.EntityName }
+
+// GetProjectName returns __RunStoppedStatusInput.ProjectName, and is useful for accessing the field via an interface.
+func (v *__RunStoppedStatusInput) GetProjectName() *string { return v.ProjectName }
+
+// GetRunId returns __RunStoppedStatusInput.RunId, and is useful for accessing the field via an interface.
+func (v *__RunStoppedStatusInput) GetRunId() string { return v.RunId }
+
+// The query or mutation executed by RunStoppedStatus.
+const RunStoppedStatus_Operation = `
+query RunStoppedStatus ($entityName: String, $projectName: String, $runId: String!) {
+	project(name: $projectName, entityName: $entityName) {
+		run(name: $runId) {
+			stopped
+		}
+	}
+}
+`
+
+func RunStoppedStatus(
+	ctx context.Context,
+	client graphql.Client,
+	entityName *string,
+	projectName *string,
+	runId string,
+) (*RunStoppedStatusResponse, error) {
+	req := &graphql.Request{
+		OpName: "RunStoppedStatus",
+		Query:  RunStoppedStatus_Operation,
+		Variables: &__RunStoppedStatusInput{
+			EntityName:  entityName,
+			ProjectName: projectName,
+			RunId:       runId,
+		},
+	}
+	var err error
+
+	var data RunStoppedStatusResponse
+	resp := &graphql.Response{Data: &data}
+
+	err = client.MakeRequest(
+		ctx,
+		req,
+		resp,
+	)
+
+	return &data, err
+}
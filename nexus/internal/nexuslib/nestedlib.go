@@ -0,0 +1,65 @@
+package nexuslib
+
+// KeyPath returns the path of a config or summary item, which is its
+// nested key if it has one and its key otherwise
+func KeyPath(key string, nestedKey []string) []string {
+	if len(nestedKey) > 0 {
+		return nestedKey
+	}
+	return []string{key}
+}
+
+// SetNested sets the value at path in the tree, creating the intermediate
+// maps and replacing intermediate values that are not maps. Siblings along
+// the path are kept, the value itself replaces what was at path.
+func SetNested(tree map[string]interface{}, path []string, value interface{}) {
+	if len(path) == 0 {
+		return
+	}
+	for _, key := range path[:len(path)-1] {
+		child, ok := tree[key].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			tree[key] = child
+		}
+		tree = child
+	}
+	tree[path[len(path)-1]] = value
+}
+
+// GetNested returns the value at path in the tree and whether it is set
+func GetNested(tree map[string]interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return nil, false
+	}
+	for _, key := range path[:len(path)-1] {
+		child, ok := tree[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		tree = child
+	}
+	value, ok := tree[path[len(path)-1]]
+	return value, ok
+}
+
+// DeleteNested removes the value at path from the tree, the maps along the
+// path are kept even if they become empty. It reports whether a value was
+// removed.
+func DeleteNested(tree map[string]interface{}, path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	for _, key := range path[:len(path)-1] {
+		child, ok := tree[key].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		tree = child
+	}
+	if _, ok := tree[path[len(path)-1]]; !ok {
+		return false
+	}
+	delete(tree, path[len(path)-1])
+	return true
+}
@@ -3,6 +3,7 @@ package nexuslib
 import (
 	"strings"
 
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/reflect/protoreflect"
 
 	"github.com/wandb/wandb/nexus/pkg/service"
@@ -18,7 +19,9 @@ func isBoolMessage(m protoreflect.Message) bool {
 	return true
 }
 
-func ProtoEncodeToDict(p *service.TelemetryRecord) map[int]interface{} {
+// ProtoEncodeToDict encodes a message like the python client does for the
+// config, keyed by field number
+func ProtoEncodeToDict(p protoreflect.ProtoMessage) map[int]interface{} {
 	pm := p.ProtoReflect()
 
 	m := make(map[int]interface{})
@@ -45,7 +48,9 @@ func ProtoEncodeToDict(p *service.TelemetryRecord) map[int]interface{} {
 					lst = append(lst, int(fd2.Number()))
 					return true
 				})
-				m[int(num)] = lst
+				if len(lst) > 0 {
+					m[int(num)] = lst
+				}
 			} else {
 				m2 := make(map[int]interface{})
 				pm2.Range(func(fd2 protoreflect.FieldDescriptor, v2 protoreflect.Value) bool {
@@ -64,3 +69,38 @@ func ProtoEncodeToDict(p *service.TelemetryRecord) map[int]interface{} {
 
 	return m
 }
+
+// RecordTypeName returns the name of the record type set in the record,
+// e.g. "history" or "output_raw", or an empty string if none is set
+func RecordTypeName(record *service.Record) string {
+	m := record.ProtoReflect()
+	fd := m.WhichOneof(m.Descriptor().Oneofs().ByName("record_type"))
+	if fd == nil {
+		return ""
+	}
+	return string(fd.Name())
+}
+
+// RecordTypeNameFromBytes returns the name of the record type of a marshaled
+// record that could not be unmarshaled, by looking for the field of its
+// record_type oneof. It returns "" if there is none.
+func RecordTypeNameFromBytes(data []byte) string {
+	fields := (&service.Record{}).ProtoReflect().Descriptor().Fields()
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return ""
+		}
+		data = data[n:]
+		fd := fields.ByNumber(num)
+		if fd != nil && fd.ContainingOneof() != nil && fd.ContainingOneof().Name() == "record_type" {
+			return string(fd.Name())
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return ""
+		}
+		data = data[n:]
+	}
+	return ""
+}
@@ -0,0 +1,26 @@
+package nexuslib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+func TestRecordTypeNameFromBytes(t *testing.T) {
+	record := &service.Record{
+		Num: 7,
+		RecordType: &service.Record_History{History: &service.HistoryRecord{
+			Item: []*service.HistoryItem{{Key: "loss", ValueJson: "0.5"}},
+		}},
+	}
+	data, err := proto.Marshal(record)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "history", RecordTypeNameFromBytes(data))
+	// a truncated record still has the tag of its type
+	assert.Equal(t, "history", RecordTypeNameFromBytes(data[:len(data)-3]))
+	assert.Equal(t, "", RecordTypeNameFromBytes([]byte{0xff}))
+}
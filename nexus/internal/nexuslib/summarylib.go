@@ -2,6 +2,7 @@ package nexuslib
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/wandb/wandb/nexus/pkg/service"
@@ -10,6 +11,7 @@ import (
 // Generic item which works with summary and history
 type genericItem interface {
 	GetKey() string
+	GetNestedKey() []string
 	GetValueJson() string
 }
 
@@ -22,7 +24,7 @@ func JsonifyItems[V genericItem](items []V) (string, error) {
 			e := fmt.Errorf("json unmarshal error: %v, items: %v", err, item)
 			return "", e
 		}
-		jsonMap[item.GetKey()] = value
+		SetNested(jsonMap, KeyPath(item.GetKey(), item.GetNestedKey()), value)
 	}
 
 	jsonBytes, err := json.Marshal(jsonMap)
@@ -32,25 +34,118 @@ func JsonifyItems[V genericItem](items []V) (string, error) {
 	return string(jsonBytes), nil
 }
 
-func ConsolidateSummaryItems[V genericItem](consolidatedSummary map[string]string, items []V) *service.Record {
-	var summaryItems []*service.SummaryItem
+// SummaryStore is where the consolidated summary is kept, by top level key
+type SummaryStore interface {
+	Get(key string) (string, bool)
+	Set(key string, value string)
+	Delete(key string)
+}
+
+// ConsolidateSummaryItems applies updates and removals to the consolidated
+// summary and returns the summary record with the changed top level keys.
+// Nested updates and removals are applied to the value of their top level
+// key, which is then sent as a whole, so the record only has nested keys
+// resolved. Items that can't be applied are skipped and reported in the error.
+func ConsolidateSummaryItems[V genericItem](consolidatedSummary SummaryStore, updates []V, removes []V) (*service.Record, error) {
+	var errs []error
+	changed := make(map[string]bool)
+	var order []string
+	change := func(key string, removed bool) {
+		if _, ok := changed[key]; !ok {
+			order = append(order, key)
+		}
+		changed[key] = removed
+	}
+
+	for _, item := range updates {
+		path := KeyPath(item.GetKey(), item.GetNestedKey())
+		if len(path) == 1 {
+			consolidatedSummary.Set(path[0], item.GetValueJson())
+			change(path[0], false)
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(item.GetValueJson()), &value); err != nil {
+			errs = append(errs, fmt.Errorf("json unmarshal error: %v, item: %v", err, item))
+			continue
+		}
+		tree, err := summaryTree(consolidatedSummary, path[0])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		SetNested(tree, path, value)
+		if err = setSummaryTree(consolidatedSummary, path[0], tree); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		change(path[0], false)
+	}
+
+	for _, item := range removes {
+		path := KeyPath(item.GetKey(), item.GetNestedKey())
+		if _, ok := consolidatedSummary.Get(path[0]); !ok {
+			continue
+		}
+		if len(path) == 1 {
+			consolidatedSummary.Delete(path[0])
+			change(path[0], true)
+			continue
+		}
+		tree, err := summaryTree(consolidatedSummary, path[0])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !DeleteNested(tree, path) {
+			continue
+		}
+		if err = setSummaryTree(consolidatedSummary, path[0], tree); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		change(path[0], false)
+	}
 
-	for i := 0; i < len(items); i++ {
-		key := items[i].GetKey()
-		value := items[i].GetValueJson()
-		consolidatedSummary[key] = value
-		summaryItems = append(summaryItems,
-			&service.SummaryItem{
-				Key:       key,
-				ValueJson: value})
+	summary := &service.SummaryRecord{}
+	for _, key := range order {
+		if changed[key] {
+			summary.Remove = append(summary.Remove, &service.SummaryItem{Key: key})
+			continue
+		}
+		value, _ := consolidatedSummary.Get(key)
+		summary.Update = append(summary.Update, &service.SummaryItem{Key: key, ValueJson: value})
 	}
 
 	record := &service.Record{
 		RecordType: &service.Record_Summary{
-			Summary: &service.SummaryRecord{
-				Update: summaryItems,
-			},
+			Summary: summary,
 		},
 	}
-	return record
+	return record, errors.Join(errs...)
+}
+
+// summaryTree returns the consolidated summary value of key wrapped in
+// a map, so that nested keys starting with key can be applied to it
+func summaryTree(consolidatedSummary SummaryStore, key string) (map[string]interface{}, error) {
+	tree := make(map[string]interface{})
+	valueJson, ok := consolidatedSummary.Get(key)
+	if !ok {
+		return tree, nil
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(valueJson), &value); err != nil {
+		return nil, fmt.Errorf("json unmarshal error: %v, summary key: %v", err, key)
+	}
+	tree[key] = value
+	return tree, nil
+}
+
+func setSummaryTree(consolidatedSummary SummaryStore, key string, tree map[string]interface{}) error {
+	valueJson, err := json.Marshal(tree[key])
+	if err != nil {
+		return fmt.Errorf("json marshal error: %v, summary key: %v", err, key)
+	}
+	consolidatedSummary.Set(key, string(valueJson))
+	return nil
 }
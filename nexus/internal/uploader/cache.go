@@ -0,0 +1,205 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is how many destinations the cache remembers when no
+// cache size is given
+const DefaultCacheSize = 100_000
+
+// uploadCache remembers the contents last uploaded to each destination, so
+// that the same contents are not uploaded there again, by this run or later
+// ones. An entry is a file named by the hash of the destination, holding the
+// hash of the contents. An entry is removed before every upload to its
+// destination and written again once the upload succeeded, so it only ever
+// has what the destination holds. Entries are touched when used, and the
+// least recently used ones are evicted when there are more than the size of
+// the cache.
+//
+// This is not the content addressed cache that was asked for: the same
+// contents sent to another destination, like another run or artifact, are
+// uploaded again. Skipping those needs the server to tell whether it has
+// the contents, which the run and artifact file queries don't ask.
+//
+// The cache trusts that nothing else changes the destinations, a run that is
+// deleted and created again is not uploaded again, so it is only used when
+// it is asked for.
+type uploadCache struct {
+	// dir is where the entries are
+	dir string
+
+	// size is how many entries are kept
+	size int
+
+	// mutex protects entries
+	mutex sync.Mutex
+
+	// entries is how many entries the cache has, -1 until they are counted.
+	// They are counted when the cache is first added to and when it is
+	// evicted, the entries added by other runs in between are not seen.
+	entries int
+}
+
+func newUploadCache(dir string, size int) *uploadCache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	return &uploadCache{dir: dir, size: size, entries: -1}
+}
+
+// taskDestination returns where a task uploads to. Upload urls are signed
+// in their query, which changes every time, the rest is where the file goes.
+func taskDestination(task *UploadTask) string {
+	u, err := url.Parse(task.Url)
+	if err != nil {
+		return task.Url
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// fileHash returns the sha256 of the contents of a file
+func fileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (c *uploadCache) path(destination string) string {
+	sum := sha256.Sum256([]byte(destination))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// has returns whether the contents with the hash were the last uploaded to
+// destination
+func (c *uploadCache) has(destination string, hash string) bool {
+	path := c.path(destination)
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != hash {
+		return false
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return true
+}
+
+// invalidate forgets what was uploaded to destination, before it is
+// uploaded to again
+func (c *uploadCache) invalidate(destination string) error {
+	err := os.Remove(c.path(destination))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries > 0 {
+		c.entries--
+	}
+	return nil
+}
+
+// set remembers that the contents with the hash were uploaded to destination
+func (c *uploadCache) set(destination string, hash string) error {
+	path := c.path(destination)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// write a new file and move it over the old one, so that runs sharing
+	// the cache never read a partial entry
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".entry-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(hash)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries < 0 {
+		entries, err := c.list()
+		if err != nil {
+			return err
+		}
+		c.entries = len(entries)
+	} else {
+		c.entries++
+	}
+	if c.entries <= c.size {
+		return nil
+	}
+	return c.evict()
+}
+
+// cacheEntry is an entry of the cache on disk
+type cacheEntry struct {
+	path    string
+	modTime time.Time
+}
+
+// list returns the entries of the cache
+func (c *uploadCache) list() ([]cacheEntry, error) {
+	var entries []cacheEntry
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			// removed by another run evicting at the same time
+			return nil
+		}
+		entries = append(entries, cacheEntry{path: path, modTime: info.ModTime()})
+		return nil
+	})
+	return entries, err
+}
+
+// evict removes the least recently used entries above the size of the
+// cache, it is called with the mutex held
+func (c *uploadCache) evict() error {
+	entries, err := c.list()
+	if err != nil {
+		return err
+	}
+	c.entries = len(entries)
+	if len(entries) <= c.size {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries[:len(entries)-c.size] {
+		if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		c.entries--
+	}
+	return nil
+}
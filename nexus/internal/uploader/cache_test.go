@@ -0,0 +1,113 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+
+	"github.com/wandb/wandb/nexus/pkg/observability"
+)
+
+func TestUploaderCache(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	logger := observability.NewNexusLogger(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	cacheDir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(path, []byte("hello"), 0644))
+
+	upload := func(url string) *UploadResult {
+		// a new uploader is a later run using the same cache
+		u := NewUploader(context.Background(), logger, Options{CacheDir: cacheDir})
+		u.Start()
+		var result *UploadResult
+		wg := &sync.WaitGroup{}
+		u.AddTask(&UploadTask{
+			Path:          path,
+			Url:           url,
+			OnComplete:    func(r *UploadResult) { result = r },
+			WgOutstanding: wg,
+		})
+		wg.Wait()
+		u.Close()
+		return result
+	}
+
+	assert.False(t, upload(server.URL+"/a?sig=1").Deduped)
+	// the same contents to the same place with a new signature are skipped
+	assert.True(t, upload(server.URL+"/a?sig=2").Deduped)
+	// but not to another place
+	assert.False(t, upload(server.URL+"/b?sig=1").Deduped)
+	// nor once the contents changed
+	assert.NoError(t, os.WriteFile(path, []byte("hello world"), 0644))
+	assert.False(t, upload(server.URL+"/a?sig=3").Deduped)
+	// nor when changing back, the place holds the last contents
+	assert.NoError(t, os.WriteFile(path, []byte("hello"), 0644))
+	assert.False(t, upload(server.URL+"/a?sig=4").Deduped)
+	assert.True(t, upload(server.URL+"/a?sig=5").Deduped)
+	assert.Equal(t, int32(4), requests.Load())
+}
+
+func TestUploaderCacheFailedUpload(t *testing.T) {
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		if fail {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	logger := observability.NewNexusLogger(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	u := NewUploader(context.Background(), logger, Options{CacheDir: t.TempDir()})
+	path := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(path, []byte("a"), 0644))
+	task := &UploadTask{Path: path, Url: server.URL + "/a"}
+	assert.NoError(t, u.upload(task).Err)
+
+	// a failed upload may have changed the destination, so it is forgotten
+	assert.NoError(t, os.WriteFile(path, []byte("b"), 0644))
+	fail = true
+	assert.Error(t, u.upload(task).Err)
+	assert.NoError(t, os.WriteFile(path, []byte("a"), 0644))
+	fail = false
+	assert.False(t, u.upload(task).Deduped)
+}
+
+func TestUploadCacheEvict(t *testing.T) {
+	cache := newUploadCache(t.TempDir(), 10)
+	old := time.Now().Add(-time.Hour)
+	for i := 0; i < 10; i++ {
+		destination := string(rune('a' + i))
+		assert.NoError(t, cache.set(destination, "hash"))
+		path := cache.path(destination)
+		assert.NoError(t, os.Chtimes(path, old.Add(time.Duration(i)*time.Minute), old.Add(time.Duration(i)*time.Minute)))
+	}
+	// nothing is evicted until the cache is over its size
+	assert.Equal(t, 10, cache.entries)
+	assert.True(t, cache.has("j", "hash"))
+	// using an entry keeps it
+	assert.True(t, cache.has("a", "hash"))
+	assert.NoError(t, cache.set("z", "hash"))
+	assert.Equal(t, 10, cache.entries)
+
+	assert.True(t, cache.has("a", "hash"))
+	assert.False(t, cache.has("b", "hash"))
+	assert.True(t, cache.has("c", "hash"))
+	assert.True(t, cache.has("z", "hash"))
+}
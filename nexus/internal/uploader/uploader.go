@@ -2,20 +2,79 @@ package uploader
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/exp/slog"
 
 	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
 
 	"github.com/hashicorp/go-retryablehttp"
 )
 
-const UploaderBufferSize = 32
+const (
+	UploaderBufferSize = 32
+
+	// DefaultConcurrency is how many files are uploaded at the same time
+	// when no concurrency is given
+	DefaultConcurrency = 16
+)
+
+// Options configure an uploader, zero values are replaced by the defaults
+type Options struct {
+	// Concurrency is how many files are uploaded at the same time
+	Concurrency int
+
+	// CacheDir is where the uploads are remembered so that files with the
+	// same contents are not uploaded again, no cache is used if it is empty
+	CacheDir string
+
+	// CacheSize is how many destinations the cache remembers
+	CacheSize int
+}
+
+// OptionsFromEnv returns the uploader options set in the environment
+func OptionsFromEnv() (Options, error) {
+	options := Options{}
+	var errs []error
+	// each option is parsed on its own, an invalid one is left to its default
+	parse := func(env string) int64 {
+		value := os.Getenv(env)
+		if value == "" {
+			return 0
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("uploader: invalid %s %q: %w", env, value, err))
+			return 0
+		}
+		return n
+	}
+	options.Concurrency = int(parse("WANDB_NEXUS_UPLOAD_CONCURRENCY"))
+	options.CacheSize = int(parse("WANDB_NEXUS_UPLOAD_CACHE_SIZE"))
+	// the cache is only used when it is asked for, see uploadCache
+	options.CacheDir = os.Getenv("WANDB_NEXUS_UPLOAD_CACHE_DIR")
+	return options, errors.Join(errs...)
+}
+
+// FileKind is the kind of an uploaded file, files are counted by kind
+type FileKind int8
+
+const (
+	OtherFile FileKind = iota
+	WandbFile
+	MediaFile
+	ArtifactFile
+)
 
 // UploadTask is a task to upload a file
 type UploadTask struct {
@@ -29,15 +88,103 @@ type UploadTask struct {
 	// headers to send on the upload
 	Headers []string
 
+	// FileKind is the kind of the file
+	FileKind FileKind
+
+	// OnComplete is called with the result of the upload, from the worker
+	// that uploaded the file
+	OnComplete func(*UploadResult)
+
 	// allow tasks to wait for completion (failed or success)
 	WgOutstanding *sync.WaitGroup
 }
 
+// UploadResult is the outcome of an upload task
+type UploadResult struct {
+	// Path is the path to the file
+	Path string
+
+	// FileKind is the kind of the file
+	FileKind FileKind
+
+	// StatusCode is the status of the last response, 0 if there was none
+	StatusCode int
+
+	// Bytes is the size of the file
+	Bytes int64
+
+	// Duration is how long the upload took, retries included
+	Duration time.Duration
+
+	// Err is set if the upload failed
+	Err error
+
+	// Retryable is whether the request failed for a reason that can go away,
+	// like the server being unavailable, rather than being refused. It is
+	// false when the upload failed before a request was sent.
+	Retryable bool
+
+	// Deduped is whether the file was not uploaded because the same
+	// contents were already uploaded to the same place
+	Deduped bool
+}
+
+// StatusError is the error of a request that got a response that is not a
+// success
+type StatusError struct {
+	Method     string
+	Url        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("uploader: %s %s: %s", e.Method, e.Url, e.Status)
+}
+
+// isRetryable returns whether a failure with the status code is retried by
+// the retry policy of the client, 0 being a failure without a response
+func isRetryable(statusCode int) bool {
+	return statusCode == 0 ||
+		statusCode == http.StatusTooManyRequests ||
+		(statusCode >= 500 && statusCode != http.StatusNotImplemented)
+}
+
+// statusCode returns the status code of a response, or 0 if there is none
+func statusCode(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+// readResponse reads and closes the body of a response, returning a
+// StatusError if its status is not a success
+func readResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// presigned urls are signed in their query, which is left out
+		url := resp.Request.URL
+		return body, &StatusError{
+			Method:     resp.Request.Method,
+			Url:        url.Scheme + "://" + url.Host + url.Path,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+	return body, nil
+}
+
+// fileCounts are the number of files added to the uploader by kind
 type fileCounts struct {
-	// wandbCount    int
-	// mediaCount    int
-	// artifactCount int
-	// otherCount    int
+	wandbCount    int32
+	mediaCount    int32
+	artifactCount int32
+	otherCount    int32
 }
 
 // Uploader uploads files to the server
@@ -51,9 +198,28 @@ type Uploader struct {
 	// retryClient is the retryable http client
 	retryClient *retryablehttp.Client
 
+	// options are the options of the uploader
+	options Options
+
+	// mutex protects fileCounts
+	mutex sync.Mutex
+
 	// fileCounts is the file counts
 	fileCounts fileCounts
 
+	// totalBytes is the size of all the files added
+	totalBytes atomic.Int64
+
+	// uploadedBytes is how much of the files has been uploaded
+	uploadedBytes atomic.Int64
+
+	// dedupedBytes is the size of the files that were not uploaded because
+	// they already were
+	dedupedBytes atomic.Int64
+
+	// cache remembers the uploads, it is nil if there is no cache
+	cache *uploadCache
+
 	// logger is the logger for the uploader
 	logger *observability.NexusLogger
 
@@ -76,46 +242,97 @@ func (t *UploadTask) outstandingDone() {
 }
 
 // NewUploader creates a new uploader
-func NewUploader(ctx context.Context, logger *observability.NexusLogger) *Uploader {
+func NewUploader(ctx context.Context, logger *observability.NexusLogger, options Options) *Uploader {
 	retryClient := retryablehttp.NewClient()
 	retryClient.Logger = slog.NewLogLogger(logger.Logger.Handler(), slog.LevelDebug)
 	retryClient.RetryMax = 10
 	retryClient.RetryWaitMin = 1 * time.Second
 	retryClient.RetryWaitMax = 60 * time.Second
+	// keep the last response once the retries ran out, to report its status
+	retryClient.ErrorHandler = retryablehttp.PassthroughErrorHandler
+
+	if options.Concurrency <= 0 {
+		options.Concurrency = DefaultConcurrency
+	}
 
 	uploader := &Uploader{
 		ctx:         ctx,
 		inChan:      make(chan *UploadTask, UploaderBufferSize),
 		retryClient: retryClient,
+		options:     options,
 		fileCounts:  fileCounts{},
 		logger:      logger,
 		wg:          &sync.WaitGroup{},
 	}
+	if options.CacheDir != "" {
+		uploader.cache = newUploadCache(options.CacheDir, options.CacheSize)
+	}
 	return uploader
 }
 
-// Start is the main loop for the uploader
+// Start starts the workers of the uploader
 func (u *Uploader) Start() {
-
-	u.wg.Add(1)
-	go func() {
-		for task := range u.inChan {
-			u.logger.Debug("uploader: got task", task)
-			if err := u.upload(task); err != nil {
-				u.logger.CaptureError("uploader: error uploading", err, "path", task.Path, "url", task.Url)
+	for i := 0; i < u.options.Concurrency; i++ {
+		u.wg.Add(1)
+		go func() {
+			for task := range u.inChan {
+				u.logger.Debug("uploader: got task", task)
+				result := u.upload(task)
+				if result.Err != nil {
+					u.logger.CaptureError("uploader: error uploading", result.Err, "path", task.Path, "status", result.StatusCode)
+				}
+				if task.OnComplete != nil {
+					task.OnComplete(result)
+				}
+				task.outstandingDone()
 			}
-		}
-		u.wg.Done()
-	}()
+			u.wg.Done()
+		}()
+	}
 }
 
 // AddTask adds a task to the uploader
 func (u *Uploader) AddTask(task *UploadTask) {
 	task.outstandingAdd()
 	u.logger.Debug("uploader: adding task", "path", task.Path, "url", task.Url)
+
+	u.mutex.Lock()
+	switch task.FileKind {
+	case WandbFile:
+		u.fileCounts.wandbCount++
+	case MediaFile:
+		u.fileCounts.mediaCount++
+	case ArtifactFile:
+		u.fileCounts.artifactCount++
+	default:
+		u.fileCounts.otherCount++
+	}
+	u.mutex.Unlock()
+	if info, err := os.Stat(task.Path); err == nil {
+		u.totalBytes.Add(info.Size())
+	}
+
 	u.inChan <- task
 }
 
+// Stats returns the upload progress and the number of files added by kind
+func (u *Uploader) Stats() (*service.FilePusherStats, *service.FileCounts) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	pusherStats := &service.FilePusherStats{
+		UploadedBytes: u.uploadedBytes.Load(),
+		TotalBytes:    u.totalBytes.Load(),
+		DedupedBytes:  u.dedupedBytes.Load(),
+	}
+	fileCounts := &service.FileCounts{
+		WandbCount:    u.fileCounts.wandbCount,
+		MediaCount:    u.fileCounts.mediaCount,
+		ArtifactCount: u.fileCounts.artifactCount,
+		OtherCount:    u.fileCounts.otherCount,
+	}
+	return pusherStats, fileCounts
+}
+
 // Close closes the uploader
 func (u *Uploader) Close() {
 	u.logger.Debug("uploader: Close")
@@ -124,33 +341,156 @@ func (u *Uploader) Close() {
 }
 
 // upload uploads a file to the server
-func (u *Uploader) upload(task *UploadTask) error {
-	// read in the file at task.Path:
-	file, err := os.ReadFile(task.Path)
+func (u *Uploader) upload(task *UploadTask) *UploadResult {
+	start := time.Now()
+	result := &UploadResult{Path: task.Path, FileKind: task.FileKind}
+
+	var destination, hash string
+	var info os.FileInfo
+	if u.cache != nil {
+		destination = taskDestination(task)
+		hash, info = u.hashFile(task.Path)
+		if hash != "" && u.cache.has(destination, hash) {
+			result.Deduped = true
+			result.Bytes = info.Size()
+			result.Duration = time.Since(start)
+			u.uploadedBytes.Add(info.Size())
+			u.dedupedBytes.Add(info.Size())
+			return result
+		}
+		// the destination no longer holds what the cache has once the
+		// upload starts, whether it succeeds or not
+		if err := u.cache.invalidate(destination); err != nil {
+			u.logger.CaptureWarn("uploader: error removing from cache", "path", task.Path, "error", err)
+		}
+	}
+
+	var sent bool
+	result.StatusCode, result.Bytes, sent, result.Err = u.uploadFile(task)
+	result.Duration = time.Since(start)
+	if result.Err != nil {
+		result.Retryable = sent && isRetryable(result.StatusCode)
+		return result
+	}
+
+	// only remember the contents if they didn't change while uploading
+	if hash != "" {
+		if after, err := os.Stat(task.Path); err == nil &&
+			after.Size() == info.Size() && after.ModTime().Equal(info.ModTime()) {
+			if err := u.cache.set(destination, hash); err != nil {
+				u.logger.CaptureWarn("uploader: error adding to cache", "path", task.Path, "error", err)
+			}
+		}
+	}
+	return result
+}
+
+// hashFile returns the hash of the contents of a file and its info from
+// before it was hashed, or an empty hash if the file can't be hashed
+func (u *Uploader) hashFile(path string) (string, os.FileInfo) {
+	info, err := os.Stat(path)
 	if err != nil {
-		return err
+		return "", nil
+	}
+	hash, err := fileHash(path)
+	if err != nil {
+		u.logger.Debug("uploader: error hashing file", "path", path, "error", err)
+		return "", nil
+	}
+	return hash, info
+}
+
+// uploadFile uploads a file and returns the status of the last response, the
+// size of the file and whether the upload got as far as sending a request
+func (u *Uploader) uploadFile(task *UploadTask) (int, int64, bool, error) {
+	info, err := os.Stat(task.Path)
+	if err != nil {
+		return 0, 0, false, err
 	}
 
+	progress := &uploadProgress{uploader: u}
 	req, err := retryablehttp.NewRequest(
 		http.MethodPut,
 		task.Url,
-		file,
+		u.fileBody(task.Path, info.Size(), progress),
 	)
+	if err != nil {
+		return 0, info.Size(), false, err
+	}
 
 	for _, header := range task.Headers {
 		parts := strings.Split(header, ":")
 		req.Header.Set(parts[0], parts[1])
 	}
 
+	resp, err := u.retryClient.Do(req)
+	if err == nil {
+		_, err = readResponse(resp)
+	}
 	if err != nil {
-		task.outstandingDone()
-		return err
+		progress.reset()
+		return statusCode(resp), info.Size(), true, err
 	}
+	return resp.StatusCode, info.Size(), true, nil
+}
 
-	if _, err = u.retryClient.Do(req); err != nil {
-		task.outstandingDone()
-		return err
+// fileBody returns the body of a request uploading the size bytes of the
+// file at path. The file is read from disk by each attempt, and the
+// bytes read by an attempt no longer count as uploaded when it is retried.
+func (u *Uploader) fileBody(path string, size int64, progress *uploadProgress) retryablehttp.ReaderFunc {
+	return func() (io.Reader, error) {
+		progress.reset()
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &progressReader{
+			file:     file,
+			reader:   io.NewSectionReader(file, 0, size),
+			left:     size,
+			progress: progress.add,
+		}, nil
 	}
-	task.outstandingDone()
-	return nil
+}
+
+// uploadProgress counts the bytes of a file sent by its current attempt
+type uploadProgress struct {
+	uploader *Uploader
+	sent     atomic.Int64
+}
+
+func (p *uploadProgress) add(n int) {
+	p.sent.Add(int64(n))
+	p.uploader.uploadedBytes.Add(int64(n))
+}
+
+// reset stops counting the bytes sent, when they are sent again or the
+// upload failed
+func (p *uploadProgress) reset() {
+	p.uploader.uploadedBytes.Add(-p.sent.Swap(0))
+}
+
+// progressReader reads a section of a file being uploaded and reports the
+// bytes read
+type progressReader struct {
+	file     *os.File
+	reader   *io.SectionReader
+	left     int64
+	progress func(n int)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.left -= int64(n)
+	r.progress(n)
+	return n, err
+}
+
+// Len returns the number of bytes left, so the request has a content length
+func (r *progressReader) Len() int {
+	return int(r.left)
+}
+
+func (r *progressReader) Close() error {
+	return r.file.Close()
 }
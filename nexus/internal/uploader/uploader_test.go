@@ -0,0 +1,133 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+
+	"github.com/wandb/wandb/nexus/pkg/observability"
+)
+
+func TestUploaderConcurrency(t *testing.T) {
+	var active, maxActive atomic.Int32
+	var received atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			old := maxActive.Load()
+			if n <= old || maxActive.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		body, _ := io.ReadAll(r.Body)
+		received.Add(int64(len(body)))
+		assert.Equal(t, int64(len(body)), r.ContentLength)
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	logger := observability.NewNexusLogger(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	u := NewUploader(context.Background(), logger, Options{Concurrency: 2})
+	u.Start()
+
+	dir := t.TempDir()
+	kinds := []FileKind{WandbFile, MediaFile, MediaFile, ArtifactFile, OtherFile}
+	wg := &sync.WaitGroup{}
+	for i, kind := range kinds {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		assert.NoError(t, os.WriteFile(path, []byte(strings.Repeat("x", 100*(i+1))), 0644))
+		u.AddTask(&UploadTask{Path: path, Url: server.URL, FileKind: kind, WgOutstanding: wg})
+	}
+	wg.Wait()
+	u.Close()
+
+	assert.Equal(t, int32(2), maxActive.Load())
+	pusherStats, fileCounts := u.Stats()
+	assert.Equal(t, int64(1500), pusherStats.TotalBytes)
+	assert.Equal(t, int64(1500), pusherStats.UploadedBytes)
+	assert.Equal(t, int64(1500), received.Load())
+	assert.Equal(t, int32(1), fileCounts.WandbCount)
+	assert.Equal(t, int32(2), fileCounts.MediaCount)
+	assert.Equal(t, int32(1), fileCounts.ArtifactCount)
+	assert.Equal(t, int32(1), fileCounts.OtherCount)
+}
+
+func TestUploaderFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		if strings.HasSuffix(r.URL.Path, "/expired") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	logger := observability.NewNexusLogger(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	u := NewUploader(context.Background(), logger, Options{})
+	u.Start()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	assert.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+	missing := filepath.Join(dir, "missing")
+	results := make(map[string]*UploadResult)
+	mutex := sync.Mutex{}
+	for _, task := range []struct{ path, url string }{
+		{path, server.URL + "/ok"},
+		{path, server.URL + "/expired"},
+		{missing, server.URL + "/ok"},
+	} {
+		url := task.url
+		u.AddTask(&UploadTask{Path: task.path, Url: url, OnComplete: func(result *UploadResult) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			results[url+" "+result.Path] = result
+		}})
+	}
+	u.Close()
+
+	ok := results[server.URL+"/ok "+path]
+	assert.NoError(t, ok.Err)
+	assert.Equal(t, http.StatusOK, ok.StatusCode)
+	assert.Equal(t, int64(4), ok.Bytes)
+
+	// a refused upload is not retried
+	expired := results[server.URL+"/expired "+path]
+	var statusErr *StatusError
+	assert.ErrorAs(t, expired.Err, &statusErr)
+	assert.Equal(t, http.StatusForbidden, expired.StatusCode)
+	assert.Equal(t, int64(4), expired.Bytes)
+	assert.False(t, expired.Retryable)
+
+	// neither is one that failed before sending a request
+	notFound := results[server.URL+"/ok "+missing]
+	assert.ErrorIs(t, notFound.Err, os.ErrNotExist)
+	assert.Equal(t, 0, notFound.StatusCode)
+	assert.False(t, notFound.Retryable)
+
+	pusherStats, _ := u.Stats()
+	assert.Equal(t, int64(4), pusherStats.UploadedBytes)
+	assert.Equal(t, int64(8), pusherStats.TotalBytes)
+}
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv("WANDB_NEXUS_UPLOAD_CONCURRENCY", "many")
+	t.Setenv("WANDB_NEXUS_UPLOAD_CACHE_SIZE", "100")
+	t.Setenv("WANDB_NEXUS_UPLOAD_CACHE_DIR", "")
+
+	// an invalid option doesn't keep the others from being used
+	options, err := OptionsFromEnv()
+	assert.ErrorContains(t, err, "WANDB_NEXUS_UPLOAD_CONCURRENCY")
+	assert.Equal(t, Options{CacheSize: 100}, options)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/md5"
 	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
@@ -23,6 +24,10 @@ type ArtifactSaver struct {
 	GraphqlClient graphql.Client
 	Uploader      *uploader.Uploader
 	WgOutstanding sync.WaitGroup
+
+	// uploadErrs are the errors of the uploads that failed
+	uploadErrs  []error
+	uploadMutex sync.Mutex
 }
 
 type ArtifactSaverResult struct {
@@ -164,6 +169,8 @@ func (as *ArtifactSaver) sendManifestFiles(artifactID string, manifestID string)
 		upload := uploader.UploadTask{
 			Url:           *edge.Node.GetUploadUrl(),
 			Path:          man.Contents[n].LocalPath,
+			FileKind:      uploader.ArtifactFile,
+			OnComplete:    as.uploadComplete,
 			WgOutstanding: &as.WgOutstanding,
 		}
 		as.Uploader.AddTask(&upload)
@@ -210,11 +217,24 @@ func (as *ArtifactSaver) sendManifest(manifestFile string, uploadUrl *string, up
 		Url:           *uploadUrl,
 		Path:          manifestFile,
 		Headers:       uploadHeaders,
+		FileKind:      uploader.ArtifactFile,
+		OnComplete:    as.uploadComplete,
 		WgOutstanding: &as.WgOutstanding,
 	}
 	as.Uploader.AddTask(&upload)
 }
 
+// uploadComplete keeps the errors of the uploads that failed, the artifact
+// is not committed if any did
+func (as *ArtifactSaver) uploadComplete(result *uploader.UploadResult) {
+	if result.Err == nil {
+		return
+	}
+	as.uploadMutex.Lock()
+	defer as.uploadMutex.Unlock()
+	as.uploadErrs = append(as.uploadErrs, fmt.Errorf("%s: %w", result.Path, result.Err))
+}
+
 func (as *ArtifactSaver) commitArtifact(artifactId string) {
 	response, err := gql.CommitArtifact(
 		as.Ctx,
@@ -244,6 +264,9 @@ func (as *ArtifactSaver) Save() (ArtifactSaverResult, error) {
 	as.sendManifest(manifestFile, uploadUrl, uploadHeaders)
 	// wait on all outstanding requests before commit
 	as.WgOutstanding.Wait()
+	if err := errors.Join(as.uploadErrs...); err != nil {
+		return ArtifactSaverResult{}, fmt.Errorf("failed to upload artifact files: %w", err)
+	}
 	as.commitArtifact(artifactId)
 
 	return ArtifactSaverResult{ArtifactId: artifactId}, nil
@@ -2,6 +2,7 @@
 // https://github.com/golang/leveldb/blob/master/record/record.go
 // Changes:
 // - Add ability to use different CRC algorithm
+// - Add Reader.Offset to find the end of the last record read
 
 // Copyright 2011 The LevelDB-Go Authors. All rights reserved.
 // Use of this source code is governed by a BSD-style
@@ -106,6 +107,9 @@ const (
 	headerSize    = 7
 )
 
+// BlockSize is the size of the blocks the stream is divided into.
+const BlockSize = blockSize
+
 var (
 	// ErrNotAnIOSeeker is returned if the io.Reader underlying a Reader does not implement io.Seeker.
 	ErrNotAnIOSeeker = errors.New("leveldb/record: reader does not implement io.Seeker")
@@ -130,6 +134,8 @@ type Reader struct {
 	// n is the number of bytes of buf that are valid. Once reading has started,
 	// only the final block can have n < blockSize.
 	n int
+	// blockOffset is the offset in r of the block held in buf.
+	blockOffset int64
 	// started is whether Next has been called at all.
 	started bool
 	// recovering is true when recovering from corruption.
@@ -214,6 +220,7 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 			}
 			return io.EOF
 		}
+		r.blockOffset += int64(r.n)
 		n, err := io.ReadFull(r.r, r.buf[:])
 		if err != nil && err != io.ErrUnexpectedEOF {
 			return err
@@ -293,6 +300,7 @@ func (r *Reader) SeekRecord(offset int64) error {
 
 	// Clear the state of the internal reader.
 	r.i, r.j, r.n = 0, 0, 0
+	r.blockOffset = offset &^ blockSizeMask
 	r.started, r.recovering, r.last = false, false, false
 	if r.err = r.nextChunk(false); r.err != nil {
 		return r.err
@@ -305,6 +313,16 @@ func (r *Reader) SeekRecord(offset int64) error {
 	return nil
 }
 
+// Offset returns the offset in the underlying io.Reader just past the last
+// chunk read so far. Once the reader returned by Next has been read to
+// exhaustion, this is the offset at which the record ends.
+//
+// The offset is relative to where reading started, or absolute if SeekRecord
+// has been called.
+func (r *Reader) Offset() int64 {
+	return r.blockOffset + int64(r.j)
+}
+
 type singleReader struct {
 	r   *Reader
 	seq int
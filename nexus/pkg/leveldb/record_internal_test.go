@@ -799,3 +799,36 @@ func TestNoLastRecordOffset(t *testing.T) {
 		t.Fatalf("LastRecordOffset: got %d, want 0", off)
 	}
 }
+
+func TestReaderOffset(t *testing.T) {
+	recs, err := makeTestRecords(
+		// The first record will consume 3 entire blocks but a fraction of the 4th.
+		blockSize*3,
+		// A small record following it in the 4th block.
+		blockSize/8,
+		// A record spilling over into the 5th block.
+		blockSize,
+	)
+	if err != nil {
+		t.Fatalf("makeTestRecords: %v", err)
+	}
+
+	r := NewReader(bytes.NewReader(recs.buf))
+	for i := range recs.records {
+		rr, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if _, err = io.Copy(io.Discard, rr); err != nil {
+			t.Fatalf("Copy: %v", err)
+		}
+		// A record ends where the next one begins, or at the end of the stream.
+		want := int64(len(recs.buf))
+		if i+1 < len(recs.offsets) {
+			want = recs.offsets[i+1]
+		}
+		if got := r.Offset(); got != want {
+			t.Errorf("record #%d: got %d, want %d", i, got, want)
+		}
+	}
+}
@@ -1,12 +1,16 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
 	"net/http"
+	"sync"
 
 	"golang.org/x/exp/slog"
 
 	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
 
 	"github.com/Khan/genqlient/graphql"
 	"github.com/hashicorp/go-retryablehttp"
@@ -28,8 +32,68 @@ func (t *authedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return t.wrapped.RoundTrip(req)
 }
 
-// newRetryClient creates a new http client
-func newRetryClient(apiKey string, logger *observability.NexusLogger) *retryablehttp.Client {
+// maxNetworkStatusResponses is how many retries are kept to be reported
+const maxNetworkStatusResponses = 64
+
+// networkStatus collects the requests to the server that are retried, so the
+// user can be shown that syncing is being retried
+type networkStatus struct {
+	// mutex protects responses
+	mutex sync.Mutex
+
+	// responses are the retries since they were last reported
+	responses []*service.HttpResponse
+}
+
+// track records the retries of the requests of a client
+func (ns *networkStatus) track(client *retryablehttp.Client) {
+	checkRetry := client.CheckRetry
+	client.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		retry, checkErr := checkRetry(ctx, resp, err)
+		if retry && ctx.Err() == nil {
+			ns.add(resp, err)
+		}
+		return retry, checkErr
+	}
+}
+
+// add records a retry. The client shows the text of responses with no status
+// as is, and the others as the status being retried.
+func (ns *networkStatus) add(resp *http.Response, err error) {
+	response := &service.HttpResponse{}
+	if resp != nil {
+		response.HttpStatusCode = int32(resp.StatusCode)
+		response.HttpResponseText = http.StatusText(resp.StatusCode)
+	} else {
+		response.HttpResponseText = fmt.Sprintf("Network error (%v), entering retry loop.", err)
+	}
+
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	// the same retry over and over is reported once
+	if n := len(ns.responses); n > 0 &&
+		ns.responses[n-1].HttpStatusCode == response.HttpStatusCode &&
+		ns.responses[n-1].HttpResponseText == response.HttpResponseText {
+		return
+	}
+	ns.responses = append(ns.responses, response)
+	if drop := len(ns.responses) - maxNetworkStatusResponses; drop > 0 {
+		ns.responses = ns.responses[drop:]
+	}
+}
+
+// drain returns the retries since it was last called
+func (ns *networkStatus) drain() []*service.HttpResponse {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	responses := ns.responses
+	ns.responses = nil
+	return responses
+}
+
+// newRetryClient creates a new http client, its retries are recorded in
+// status if it is not nil
+func newRetryClient(apiKey string, logger *observability.NexusLogger, status *networkStatus) *retryablehttp.Client {
 	tr := &authedTransport{
 		key:     apiKey,
 		wrapped: http.DefaultTransport,
@@ -37,12 +101,15 @@ func newRetryClient(apiKey string, logger *observability.NexusLogger) *retryable
 	retryClient := retryablehttp.NewClient()
 	retryClient.Logger = slog.NewLogLogger(logger.Logger.Handler(), slog.LevelDebug)
 	retryClient.HTTPClient.Transport = tr
+	if status != nil {
+		status.track(retryClient)
+	}
 	return retryClient
 }
 
 // newGraphqlClient creates a new graphql client
-func newGraphqlClient(url, apiKey string, logger *observability.NexusLogger) graphql.Client {
-	retryClient := newRetryClient(apiKey, logger)
+func newGraphqlClient(url, apiKey string, logger *observability.NexusLogger, status *networkStatus) graphql.Client {
+	retryClient := newRetryClient(apiKey, logger, status)
 	httpClient := retryClient.StandardClient()
 	return graphql.NewClient(url, httpClient)
 }
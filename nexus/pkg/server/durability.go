@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+// DurabilityPolicy decides when the writer commits the transaction log to
+// stable storage. Records stored after the last commit may be lost if the
+// process is killed. Several conditions can be combined.
+type DurabilityPolicy struct {
+	// Records commits once this many records have been stored, 0 disables
+	Records int
+
+	// Interval commits this long after the first uncommitted record, 0 disables
+	Interval time.Duration
+
+	// OnExit commits on the exit record and on every defer state
+	OnExit bool
+}
+
+// ParseDurabilityPolicy parses a comma separated list of commit conditions:
+// "none", "exit", "records:<n>" and "interval:<duration>",
+// e.g. "records:1000,interval:500ms,exit"
+func ParseDurabilityPolicy(policy string) (DurabilityPolicy, error) {
+	p := DurabilityPolicy{}
+	for _, condition := range strings.Split(policy, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(condition), ":")
+		switch name {
+		case "", "none":
+		case "exit":
+			p.OnExit = true
+		case "records":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return p, fmt.Errorf("durability: invalid number of records %q", value)
+			}
+			p.Records = n
+		case "interval":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return p, fmt.Errorf("durability: invalid interval %q", value)
+			}
+			p.Interval = d
+		default:
+			return p, fmt.Errorf("durability: unknown condition %q", name)
+		}
+	}
+	return p, nil
+}
+
+// DurabilityPolicyFromEnv returns the durability policy set in the
+// environment, by default the log is committed on exit
+func DurabilityPolicyFromEnv() (DurabilityPolicy, error) {
+	policy, ok := os.LookupEnv("WANDB_NEXUS_STORE_SYNC")
+	if !ok {
+		return DurabilityPolicy{OnExit: true}, nil
+	}
+	return ParseDurabilityPolicy(policy)
+}
+
+// isCommitPoint is whether the record itself requires a commit
+func (p DurabilityPolicy) isCommitPoint(record *service.Record) bool {
+	if !p.OnExit {
+		return false
+	}
+	switch record.RecordType.(type) {
+	case *service.Record_Exit:
+		return true
+	case *service.Record_Request:
+		return record.GetRequest().GetDefer() != nil
+	}
+	return false
+}
+
+// enabled is whether the log is ever committed before it is closed
+func (p DurabilityPolicy) enabled() bool {
+	return p.Records > 0 || p.Interval > 0 || p.OnExit
+}
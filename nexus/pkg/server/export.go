@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/wandb/wandb/nexus/internal/nexuslib"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+const HistoryCsvFileName = "wandb-history.csv"
+
+// Exporter writes the files the file stream would have uploaded for a run
+// from its transaction log, so offline runs can be analysed locally.
+type Exporter struct {
+	// ctx is the context for the exporter
+	ctx context.Context
+
+	// logger is the logger for the exporter
+	logger *observability.NexusLogger
+
+	// store is the transaction log being exported
+	store *Store
+
+	// dir is the directory the files are written to
+	dir string
+
+	// csv is whether to also write the history as a csv file
+	csv bool
+
+	// startTime is the start time of the run
+	startTime float64
+
+	// files are the open line oriented files by name
+	files map[string]*bufio.Writer
+
+	// summary is the consolidated summary of the run
+	summary map[string]*service.SummaryItem
+
+	// historyKeys are all the keys seen in the history
+	historyKeys map[string]struct{}
+
+	// outputBuffer turns the console output into lines
+	outputBuffer *outputBuffer
+
+	// output are the console output lines by line number
+	output []string
+}
+
+// NewExporter creates a new exporter for the transaction log fileName
+func NewExporter(ctx context.Context, fileName string, dir string, csv bool, logger *observability.NexusLogger) *Exporter {
+	exporter := &Exporter{
+		ctx:          ctx,
+		logger:       logger,
+		store:        NewStore(ctx, fileName, logger),
+		dir:          dir,
+		csv:          csv,
+		files:        make(map[string]*bufio.Writer),
+		summary:      make(map[string]*service.SummaryItem),
+		historyKeys:  make(map[string]struct{}),
+		outputBuffer: newOutputBuffer(),
+	}
+	return exporter
+}
+
+// Do exports the transaction log
+func (e *Exporter) Do() error {
+	if err := e.store.Open(os.O_RDONLY); err != nil {
+		return err
+	}
+	defer func() {
+		if err := e.store.Close(); err != nil {
+			e.logger.CaptureError("exporter: error closing store", err)
+		}
+	}()
+
+	if err := os.MkdirAll(e.dir, 0755); err != nil {
+		return err
+	}
+
+	var fds []*os.File
+	for _, name := range []string{HistoryFileName, EventsFileName, OutputFileName} {
+		f, err := os.Create(filepath.Join(e.dir, name))
+		if err != nil {
+			return err
+		}
+		fds = append(fds, f)
+		e.files[name] = bufio.NewWriter(f)
+	}
+	defer func() {
+		for _, f := range fds {
+			_ = f.Close()
+		}
+	}()
+
+	for {
+		record, err := e.store.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			e.logger.CaptureError("exporter: error reading record", err)
+			e.store.Recover()
+			continue
+		}
+		if err = e.exportRecord(record); err != nil {
+			return err
+		}
+	}
+
+	e.addOutputLines(e.outputBuffer.flush())
+	for _, line := range e.output {
+		if err := e.writeLine(OutputFileName, line); err != nil {
+			return err
+		}
+	}
+
+	for _, w := range e.files {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := e.writeSummary(); err != nil {
+		return err
+	}
+	if e.csv {
+		return e.writeHistoryCsv()
+	}
+	return nil
+}
+
+// exportRecord adds a record to the file it would have been streamed to
+func (e *Exporter) exportRecord(record *service.Record) error {
+	switch x := record.RecordType.(type) {
+	case *service.Record_Run:
+		if x.Run.StartTime != nil {
+			e.startTime = float64(x.Run.StartTime.AsTime().UnixMicro()) / 1e6
+		}
+	case *service.Record_History:
+		line, err := nexuslib.JsonifyItems(x.History.Item)
+		if err != nil {
+			return err
+		}
+		for _, item := range x.History.Item {
+			e.historyKeys[item.Key] = struct{}{}
+		}
+		return e.writeLine(HistoryFileName, line)
+	case *service.Record_Stats:
+		line, err := systemMetricsLine(x.Stats, e.startTime, e.logger)
+		if err != nil {
+			return err
+		}
+		return e.writeLine(EventsFileName, line)
+	case *service.Record_Summary:
+		for _, item := range x.Summary.Update {
+			e.summary[item.Key] = item
+		}
+		for _, item := range x.Summary.Remove {
+			delete(e.summary, item.Key)
+		}
+	case *service.Record_OutputRaw:
+		e.addOutputLines(e.outputBuffer.write(x.OutputRaw, x.OutputRaw.GetTimestamp().AsTime()))
+	}
+	return nil
+}
+
+// addOutputLines keeps the output lines by number, rewritten lines replace
+// the lines they were before
+func (e *Exporter) addOutputLines(lines []outputLine) {
+	for _, line := range lines {
+		for len(e.output) <= line.num {
+			e.output = append(e.output, "")
+		}
+		e.output[line.num] = line.streamText()
+	}
+}
+
+func (e *Exporter) writeLine(fileName string, line string) error {
+	w := e.files[fileName]
+	if _, err := w.WriteString(line); err != nil {
+		return err
+	}
+	return w.WriteByte('\n')
+}
+
+// writeSummary writes the consolidated summary, which is what the last
+// summary update streamed to the server contains
+func (e *Exporter) writeSummary() error {
+	var items []*service.SummaryItem
+	for _, item := range e.summary {
+		items = append(items, item)
+	}
+	line, err := nexuslib.JsonifyItems(items)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(e.dir, SummaryFileName), []byte(line), 0644)
+}
+
+// writeHistoryCsv writes the history as a csv file with a column per key,
+// reading back the history file so that memory only grows with the keys
+func (e *Exporter) writeHistoryCsv() error {
+	keys := make([]string, 0, len(e.historyKeys))
+	for key := range e.historyKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	in, err := os.Open(filepath.Join(e.dir, HistoryFileName))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(e.dir, HistoryCsvFileName))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := csv.NewWriter(out)
+	if err = w.Write(keys); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bufio.NewReader(in))
+	decoder.UseNumber()
+	row := make([]string, len(keys))
+	for {
+		var values map[string]interface{}
+		if err = decoder.Decode(&values); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			row[i], err = csvValue(values[key])
+			if err != nil {
+				return err
+			}
+		}
+		if err = w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// csvValue formats a history value as a csv cell, nested values are
+// written as json and missing values are left empty
+func csvValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprintf("%t", v), nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/pkg/service"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestExport(t *testing.T) {
+	store := makeStore(t)
+	assert.NoError(t, store.Open(os.O_WRONLY))
+	records := []*service.Record{
+		{RecordType: &service.Record_History{History: &service.HistoryRecord{
+			Item: []*service.HistoryItem{{Key: "_step", ValueJson: "0"}, {Key: "loss", ValueJson: "0.5"}}}}},
+		{RecordType: &service.Record_Summary{Summary: &service.SummaryRecord{
+			Update: []*service.SummaryItem{{Key: "loss", ValueJson: "0.5"}}}}},
+		{RecordType: &service.Record_History{History: &service.HistoryRecord{
+			Item: []*service.HistoryItem{{Key: "_step", ValueJson: "1"}, {Key: "acc", ValueJson: "\"high\""}}}}},
+		{RecordType: &service.Record_Summary{Summary: &service.SummaryRecord{
+			Update: []*service.SummaryItem{{Key: "acc", ValueJson: "\"high\""}}}}},
+		{RecordType: &service.Record_OutputRaw{OutputRaw: &service.OutputRawRecord{
+			OutputType: service.OutputRawRecord_STDOUT, Line: "hello", Timestamp: timestamppb.New(time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC))}}},
+		{RecordType: &service.Record_OutputRaw{OutputRaw: &service.OutputRawRecord{
+			OutputType: service.OutputRawRecord_STDOUT, Line: "\n", Timestamp: timestamppb.New(time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC))}}},
+		{RecordType: &service.Record_OutputRaw{OutputRaw: &service.OutputRawRecord{
+			OutputType: service.OutputRawRecord_STDOUT, Line: "10%\r100%\n", Timestamp: timestamppb.New(time.Date(2023, 7, 1, 0, 0, 1, 0, time.UTC))}}},
+	}
+	for _, record := range records {
+		assert.NoError(t, store.storeRecord(record))
+	}
+	assert.NoError(t, store.Close())
+
+	dir := t.TempDir()
+	exporter := NewExporter(context.Background(), store.name, dir, true, store.logger)
+	assert.NoError(t, exporter.Do())
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		return string(data)
+	}
+	assert.Equal(t, "{\"_step\":0,\"loss\":0.5}\n{\"_step\":1,\"acc\":\"high\"}\n", read(HistoryFileName))
+	assert.Equal(t, "{\"acc\":\"high\",\"loss\":0.5}", read(SummaryFileName))
+	assert.Equal(t, "2023-07-01T00:00:00Z hello\n2023-07-01T00:00:01Z 100%\n", read(OutputFileName))
+	assert.Equal(t, "_step,acc,loss\n0,,0.5\n1,high,\n", read(HistoryCsvFileName))
+}
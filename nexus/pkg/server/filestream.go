@@ -2,11 +2,16 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -22,8 +27,22 @@ const (
 	SummaryFileName = "wandb-summary.json"
 	OutputFileName  = "output.log"
 	maxItemsPerPush = 5_000
-	delayProcess    = 20 * time.Millisecond
-	heartbeatTime   = 2 * time.Second
+
+	// maxRequestBytes is the most bytes of json sent in a request, below the
+	// limit on the size of requests to the server
+	maxRequestBytes = (10 << 20) - (100 << 10)
+
+	delayProcess  = 20 * time.Millisecond
+	heartbeatTime = 2 * time.Second
+
+	// fileStreamBackoffMin and fileStreamBackoffMax are the waits between
+	// attempts to send a request that failed after its retries
+	fileStreamBackoffMin = 2 * time.Second
+	fileStreamBackoffMax = time.Minute
+
+	// fileStreamCloseTimeout is how long requests that could not be sent are
+	// still retried once the stream is closed
+	fileStreamCloseTimeout = 5 * time.Minute
 )
 
 var completeTrue bool = true
@@ -44,9 +63,21 @@ type chunkData struct {
 	Complete *bool
 }
 
+// size returns the bytes of the line of a chunk
+func (c *chunkData) size() int {
+	if c.fileData == nil {
+		return 0
+	}
+	return len(c.fileData.line)
+}
+
 type chunkLine struct {
 	chunkType chunkFile
 	line      string
+
+	// lineNum is the number of an output line, rewritten lines are sent
+	// again with the same number
+	lineNum int
 }
 
 // FsChunkData is the data for a chunk of a file
@@ -55,6 +86,22 @@ type FsChunkData struct {
 	Content []string `json:"content"`
 }
 
+// FsReply is the reply of the server to a file stream request
+type FsReply struct {
+	// Exitcode is set once the run is finished on the server, when it is
+	// set before the run sent its exit the run was stopped from the UI
+	Exitcode *int32 `json:"exitcode,omitempty"`
+
+	// Limits are the limits the server sets on the run
+	Limits *FsLimits `json:"limits,omitempty"`
+}
+
+// FsLimits are the limits the server sets on the run
+type FsLimits struct {
+	// RateLimitSeconds is how long to wait at least between requests
+	RateLimitSeconds *float64 `json:"rate_limit_seconds,omitempty"`
+}
+
 type FsData struct {
 	Files    map[string]FsChunkData `json:"files,omitempty"`
 	Complete *bool                  `json:"complete,omitempty"`
@@ -71,12 +118,45 @@ type FileStream struct {
 	chunkChan chan chunkData
 
 	// replyChan is the channel for replies
-	replyChan chan map[string]interface{}
+	replyChan chan *FsReply
 
 	// wg is the wait group
-	recordWait *sync.WaitGroup
-	chunkWait  *sync.WaitGroup
-	replyWait  *sync.WaitGroup
+	recordWait   *sync.WaitGroup
+	chunkWait    *sync.WaitGroup
+	transmitWait *sync.WaitGroup
+	replyWait    *sync.WaitGroup
+
+	// spill has the requests waiting to be sent, they pile up there while
+	// the server can't be reached
+	spill *spillBuffer
+
+	// backoffMin and backoffMax are the waits between attempts to send a
+	// request that failed
+	backoffMin time.Duration
+	backoffMax time.Duration
+
+	// closeTimeout is how long requests are retried once the stream is closed
+	closeTimeout time.Duration
+
+	// maxRequestBytes is the most bytes of json sent in a request
+	maxRequestBytes int
+
+	// compress is whether requests are compressed with gzip, it is turned
+	// off if the server refuses them
+	compress bool
+
+	// ctx is cancelled to give up sending the requests that are left
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// statusMutex protects degraded and statusResponses
+	statusMutex sync.Mutex
+
+	// degraded is whether the last request failed
+	degraded bool
+
+	// statusResponses are the changes of the network status to report
+	statusResponses []*service.HttpResponse
 
 	path string
 
@@ -94,22 +174,48 @@ type FileStream struct {
 
 	// keep track of the exit chunk for when we shut down filestream
 	stageExitChunk *chunkData
+
+	// exiting is whether the run sent its exit, after which the server
+	// replies with an exit code
+	exiting atomic.Bool
+
+	// stopRequested is whether the server asked for the run to stop
+	stopRequested atomic.Bool
+
+	// rateLimit is how long to wait at least between requests, as asked by
+	// the server
+	rateLimit atomic.Int64
 }
 
 // NewFileStream creates a new filestream
 func NewFileStream(path string, settings *service.Settings, logger *observability.NexusLogger) *FileStream {
+	// the retries are not recorded in the network status, the file stream
+	// reports its own status once they run out
+	httpClient := newRetryClient(settings.GetApiKey().GetValue(), logger, nil)
+	// keep the last response once the retries ran out, to report its status
+	httpClient.ErrorHandler = retryablehttp.PassthroughErrorHandler
+	ctx, cancel := context.WithCancel(context.Background())
 	fs := FileStream{
-		settings:   settings,
-		logger:     logger,
-		httpClient: newRetryClient(settings.GetApiKey().GetValue(), logger),
-		recordWait: &sync.WaitGroup{},
-		chunkWait:  &sync.WaitGroup{},
-		replyWait:  &sync.WaitGroup{},
-		recordChan: make(chan *service.Record, BufferSize),
-		chunkChan:  make(chan chunkData, BufferSize),
-		replyChan:  make(chan map[string]interface{}, BufferSize),
-		offset:     make(map[chunkFile]int),
-		path:       path,
+		settings:        settings,
+		logger:          logger,
+		httpClient:      httpClient,
+		recordWait:      &sync.WaitGroup{},
+		chunkWait:       &sync.WaitGroup{},
+		transmitWait:    &sync.WaitGroup{},
+		replyWait:       &sync.WaitGroup{},
+		recordChan:      make(chan *service.Record, BufferSize),
+		chunkChan:       make(chan chunkData, BufferSize),
+		replyChan:       make(chan *FsReply, BufferSize),
+		offset:          make(map[chunkFile]int),
+		path:            path,
+		spill:           newSpillBuffer(settings.GetTmpDir().GetValue(), spillMemorySize, spillDiskSize),
+		backoffMin:      fileStreamBackoffMin,
+		backoffMax:      fileStreamBackoffMax,
+		closeTimeout:    fileStreamCloseTimeout,
+		maxRequestBytes: maxRequestBytes,
+		compress:        os.Getenv("WANDB_NEXUS_FILE_STREAM_GZIP") == "true",
+		ctx:             ctx,
+		cancel:          cancel,
 	}
 	return &fs
 }
@@ -134,6 +240,12 @@ func (fs *FileStream) Start() {
 		fs.chunkWait.Done()
 	}()
 
+	fs.transmitWait.Add(1)
+	go func() {
+		fs.doTransmit()
+		fs.transmitWait.Done()
+	}()
+
 	fs.replyWait.Add(1)
 	go func() {
 		fs.doReplyProcess(fs.replyChan)
@@ -149,7 +261,7 @@ func (fs *FileStream) pushChunk(chunk chunkData) {
 	fs.chunkChan <- chunk
 }
 
-func (fs *FileStream) pushReply(reply map[string]interface{}) {
+func (fs *FileStream) pushReply(reply *FsReply) {
 	fs.replyChan <- reply
 }
 
@@ -161,12 +273,8 @@ func (fs *FileStream) doRecordProcess(inChan <-chan *service.Record) {
 		switch x := record.RecordType.(type) {
 		case *service.Record_History:
 			fs.streamHistory(x.History)
-		case *service.Record_Summary:
-			fs.streamSummary(x.Summary)
 		case *service.Record_Stats:
 			fs.streamSystemMetrics(x.Stats)
-		case *service.Record_OutputRaw:
-			fs.streamOutputRaw(x.OutputRaw)
 		case *service.Record_Exit:
 			fs.streamFinish(x.Exit)
 		case nil:
@@ -185,6 +293,8 @@ func (fs *FileStream) doChunkProcess(inChan <-chan chunkData) {
 
 	for active := true; active; {
 		var chunkMaps = make(map[string][]chunkData)
+		// chunkBytes are the bytes of the lines in chunkMaps by file name
+		var chunkBytes = make(map[string]int)
 		select {
 		case chunk, ok := <-inChan:
 			if !ok {
@@ -193,11 +303,15 @@ func (fs *FileStream) doChunkProcess(inChan <-chan chunkData) {
 			}
 
 			chunkMaps[chunk.fileName] = append(chunkMaps[chunk.fileName], chunk)
+			chunkBytes[chunk.fileName] += chunk.size()
 
 			delayTime := delayProcess
 			if overflow {
 				delayTime = 0
 			}
+			if rateLimit := time.Duration(fs.rateLimit.Load()); rateLimit > delayTime {
+				delayTime = rateLimit
+			}
 			delayChan := time.After(delayTime)
 			overflow = false
 
@@ -210,7 +324,9 @@ func (fs *FileStream) doChunkProcess(inChan <-chan chunkData) {
 						break
 					}
 					chunkMaps[chunk.fileName] = append(chunkMaps[chunk.fileName], chunk)
-					if len(chunkMaps[chunk.fileName]) >= maxItemsPerPush {
+					chunkBytes[chunk.fileName] += chunk.size()
+					if len(chunkMaps[chunk.fileName]) >= maxItemsPerPush ||
+						chunkBytes[chunk.fileName] >= fs.maxRequestBytes {
 						ready = false
 						overflow = true
 					}
@@ -221,7 +337,7 @@ func (fs *FileStream) doChunkProcess(inChan <-chan chunkData) {
 			for _, chunkList := range chunkMaps {
 				fs.sendChunkList(chunkList)
 			}
-		case <-time.After(heartbeatTime):
+		case <-time.After(fs.heartbeat()):
 			for _, chunkList := range chunkMaps {
 				if len(chunkList) > 0 {
 					fs.sendChunkList(chunkList)
@@ -234,11 +350,39 @@ func (fs *FileStream) doChunkProcess(inChan <-chan chunkData) {
 	}
 }
 
-func (fs *FileStream) doReplyProcess(inChan <-chan map[string]interface{}) {
-	for range inChan {
+func (fs *FileStream) doReplyProcess(inChan <-chan *FsReply) {
+	for reply := range inChan {
+		fs.handleReply(reply)
 	}
 }
 
+// handleReply acts on what the server asks for in a reply
+func (fs *FileStream) handleReply(reply *FsReply) {
+	if reply.Exitcode != nil && !fs.exiting.Load() && !fs.stopRequested.Swap(true) {
+		fs.logger.Info("filestream: run stop requested", "exitcode", *reply.Exitcode)
+	}
+	if limits := reply.Limits; limits != nil && limits.RateLimitSeconds != nil {
+		rateLimit := time.Duration(*limits.RateLimitSeconds * float64(time.Second))
+		if old := fs.rateLimit.Swap(int64(rateLimit)); old != int64(rateLimit) {
+			fs.logger.Info("filestream: rate limit changed", "rate_limit", rateLimit)
+		}
+	}
+}
+
+// heartbeat returns how long to wait for chunks before sending the ones
+// that are waiting
+func (fs *FileStream) heartbeat() time.Duration {
+	if rateLimit := time.Duration(fs.rateLimit.Load()); rateLimit > heartbeatTime {
+		return rateLimit
+	}
+	return heartbeatTime
+}
+
+// StopRequested returns whether the server asked for the run to stop
+func (fs *FileStream) StopRequested() bool {
+	return fs.stopRequested.Load()
+}
+
 func (fs *FileStream) streamHistory(msg *service.HistoryRecord) {
 	line, err := nexuslib.JsonifyItems(msg.Item)
 	if err != nil {
@@ -254,11 +398,8 @@ func (fs *FileStream) streamHistory(msg *service.HistoryRecord) {
 	fs.pushChunk(chunk)
 }
 
-func (fs *FileStream) streamSummary(msg *service.SummaryRecord) {
-	line, err := nexuslib.JsonifyItems(msg.Update)
-	if err != nil {
-		fs.logger.CaptureFatalAndPanic("json unmarshal error", err)
-	}
+// StreamSummary streams the whole summary, as one json line
+func (fs *FileStream) StreamSummary(line string) {
 	chunk := chunkData{
 		fileName: SummaryFileName,
 		fileData: &chunkLine{
@@ -269,18 +410,38 @@ func (fs *FileStream) streamSummary(msg *service.SummaryRecord) {
 	fs.pushChunk(chunk)
 }
 
-func (fs *FileStream) streamOutputRaw(msg *service.OutputRawRecord) {
+// StreamOutputLines streams console output lines, lines that were sent
+// before replace what was sent
+func (fs *FileStream) StreamOutputLines(lines []outputLine) {
+	for _, line := range lines {
+		chunk := chunkData{
+			fileName: OutputFileName,
+			fileData: &chunkLine{
+				chunkType: outputChunk,
+				line:      line.streamText(),
+				lineNum:   line.num,
+			},
+		}
+		fs.pushChunk(chunk)
+	}
+}
+
+func (fs *FileStream) streamSystemMetrics(msg *service.StatsRecord) {
+	line, err := systemMetricsLine(msg, fs.settings.XStartTime.GetValue(), fs.logger)
+	if err != nil {
+		fs.logger.CaptureError("sender: sendSystemMetrics: failed to marshal system metrics", err)
+		return
+	}
+
 	chunk := chunkData{
-		fileName: OutputFileName,
-		fileData: &chunkLine{
-			chunkType: outputChunk,
-			line:      msg.Line,
-		},
+		fileName: EventsFileName,
+		fileData: &chunkLine{chunkType: eventsChunk, line: line},
 	}
 	fs.pushChunk(chunk)
 }
 
-func (fs *FileStream) streamSystemMetrics(msg *service.StatsRecord) {
+// systemMetricsLine builds the events file line for a system metrics record
+func systemMetricsLine(msg *service.StatsRecord, startTime float64, logger *observability.NexusLogger) (string, error) {
 	// todo: there is a lot of unnecessary overhead here,
 	//  we should prepare all the data in the system monitor
 	//  and then send it in one record
@@ -288,14 +449,14 @@ func (fs *FileStream) streamSystemMetrics(msg *service.StatsRecord) {
 	row["_wandb"] = true
 	timestamp := float64(msg.GetTimestamp().Seconds) + float64(msg.GetTimestamp().Nanos)/1e9
 	row["_timestamp"] = timestamp
-	row["_runtime"] = timestamp - fs.settings.XStartTime.GetValue()
+	row["_runtime"] = timestamp - startTime
 
 	for _, item := range msg.Item {
 		var val interface{}
 		if err := json.Unmarshal([]byte(item.ValueJson), &val); err != nil {
 			e := fmt.Errorf("json unmarshal error: %v, items: %v", err, item)
 			errMsg := fmt.Sprintf("sender: sendSystemMetrics: failed to marshal value: %s for key: %s", item.ValueJson, item.Key)
-			fs.logger.CaptureError(errMsg, e)
+			logger.CaptureError(errMsg, e)
 			continue
 		}
 
@@ -305,20 +466,15 @@ func (fs *FileStream) streamSystemMetrics(msg *service.StatsRecord) {
 	// marshal the row
 	line, err := json.Marshal(row)
 	if err != nil {
-		fs.logger.CaptureError("sender: sendSystemMetrics: failed to marshal system metrics", err)
-		return
+		return "", err
 	}
-
-	chunk := chunkData{
-		fileName: EventsFileName,
-		fileData: &chunkLine{chunkType: eventsChunk, line: string(line)},
-	}
-	fs.pushChunk(chunk)
+	return string(line), nil
 }
 
 func (fs *FileStream) streamFinish(exitRecord *service.RunExitRecord) {
 	// exitChunk is sent last, so instead of pushing to the chunk channel we
 	// stage it to be sent after processing all other chunks
+	fs.exiting.Store(true)
 	fs.stageExitChunk = &chunkData{Complete: &completeTrue, Exitcode: &exitRecord.ExitCode}
 }
 
@@ -328,6 +484,11 @@ func (fs *FileStream) StreamRecord(rec *service.Record) {
 }
 
 func (fs *FileStream) sendChunkList(chunks []chunkData) {
+	if len(chunks) > 0 && chunks[0].fileData != nil && chunks[0].fileData.chunkType == outputChunk {
+		fs.sendOutputChunkList(chunks)
+		return
+	}
+
 	var lines []string
 	var complete *bool
 	var exitcode *int32
@@ -360,36 +521,242 @@ func (fs *FileStream) sendChunkList(chunks []chunkData) {
 	fs.send(data)
 }
 
-func (fs *FileStream) send(data interface{}) {
+// sendOutputChunkList sends output lines by their line number. Lines can be
+// rewritten so they are not always contiguous, each run of contiguous lines
+// is sent at its own offset.
+func (fs *FileStream) sendOutputChunkList(chunks []chunkData) {
+	// the last text of a line wins
+	texts := make(map[int]string)
+	for _, chunk := range chunks {
+		texts[chunk.fileData.lineNum] = chunk.fileData.line
+	}
+	nums := make([]int, 0, len(texts))
+	for num := range texts {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	for start := 0; start < len(nums); {
+		end := start + 1
+		for end < len(nums) && nums[end] == nums[end-1]+1 {
+			end++
+		}
+		lines := make([]string, 0, end-start)
+		for _, num := range nums[start:end] {
+			lines = append(lines, texts[num])
+		}
+		fsChunk := FsChunkData{
+			Offset:  fs.offset[outputChunk] + nums[start],
+			Content: lines,
+		}
+		fs.send(FsData{Files: map[string]FsChunkData{OutputFileName: fsChunk}})
+		start = end
+	}
+}
+
+// splitFsData splits the lines of a request in two requests, the second
+// one ends the stream if the request did
+func splitFsData(data FsData) (FsData, FsData, bool) {
+	if len(data.Files) != 1 {
+		return data, data, false
+	}
+	for name, chunk := range data.Files {
+		if len(chunk.Content) < 2 {
+			return data, data, false
+		}
+		half := len(chunk.Content) / 2
+		first := FsData{Files: map[string]FsChunkData{
+			name: {Offset: chunk.Offset, Content: chunk.Content[:half]},
+		}}
+		second := FsData{
+			Files: map[string]FsChunkData{
+				name: {Offset: chunk.Offset + half, Content: chunk.Content[half:]},
+			},
+			Complete: data.Complete,
+			Exitcode: data.Exitcode,
+		}
+		return first, second, true
+	}
+	return data, data, false
+}
+
+// send queues a request to be sent after the ones before it, so that the
+// lines of a file get to the server in order whatever happens to the network.
+// Requests larger than the size limit are split, down to a line on its own:
+// a line larger than the limit is sent alone, the limit is below the one of
+// the server to leave room for it. Lines can't be cut, history and events
+// lines are json and output lines are numbered.
+func (fs *FileStream) send(data FsData) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		fs.logger.CaptureFatalAndPanic("json marshal error", err)
+		fs.logger.CaptureError("filestream: json marshal error", err)
+		return
 	}
-	fs.logger.Debug("filestream: post request", "request", string(jsonData))
+	if len(jsonData) > fs.maxRequestBytes {
+		if first, second, ok := splitFsData(data); ok {
+			fs.send(first)
+			fs.send(second)
+			return
+		}
+	}
+	if err := fs.spill.push(jsonData); err != nil {
+		fs.logger.CaptureError("filestream: dropping request", err)
+	}
+}
 
-	buffer := bytes.NewBuffer(jsonData)
-	req, err := retryablehttp.NewRequest(http.MethodPost, fs.path, buffer)
+// doTransmit sends the queued requests one at a time. A request that fails
+// is retried with a backoff until it is sent, and the ones after it wait.
+// The offsets of the files are in the requests, so sending resumes where it
+// stopped.
+func (fs *FileStream) doTransmit() {
+	backoff := fs.backoffMin
+	for {
+		data, ok, err := fs.spill.next()
+		if !ok {
+			return
+		}
+		if err != nil {
+			fs.logger.CaptureError("filestream: error reading spilled request", err)
+			fs.spill.remove()
+			continue
+		}
+
+		statusCode, err := fs.post(data)
+		if err == nil {
+			fs.spill.remove()
+			fs.setDegraded(false, 0, nil)
+			backoff = fs.backoffMin
+			continue
+		}
+		// servers that don't take compressed requests refuse them, they are
+		// sent again uncompressed
+		if fs.compress && (statusCode == http.StatusBadRequest || statusCode == http.StatusUnsupportedMediaType) {
+			fs.logger.CaptureWarn("filestream: compressed request refused, sending uncompressed", "status", statusCode)
+			fs.compress = false
+			continue
+		}
+		// requests the server refused won't get through by retrying them
+		if statusCode >= 400 && statusCode < 500 && statusCode != http.StatusTooManyRequests {
+			fs.logger.CaptureError("filestream: request refused", err, "status", statusCode)
+			fs.spill.remove()
+			continue
+		}
+
+		fs.logger.Warn("filestream: error sending request, retrying", "error", err, "backoff", backoff, "pending", fs.spill.len())
+		fs.setDegraded(true, statusCode, err)
+		select {
+		case <-time.After(backoff):
+		case <-fs.ctx.Done():
+			n := fs.spill.clear()
+			fs.logger.CaptureError("filestream: giving up sending requests", err, "dropped", n)
+			continue
+		}
+		backoff *= 2
+		if backoff > fs.backoffMax {
+			backoff = fs.backoffMax
+		}
+	}
+}
+
+// post sends a request and returns the status of the response
+func (fs *FileStream) post(data []byte) (int, error) {
+	fs.logger.Debug("filestream: post request", "request", string(data))
+
+	body := data
+	if fs.compress {
+		var err error
+		if body, err = gzipData(data); err != nil {
+			return 0, err
+		}
+	}
+	req, err := retryablehttp.NewRequestWithContext(fs.ctx, http.MethodPost, fs.path, body)
 	if err != nil {
-		fs.logger.CaptureFatalAndPanic("filestream: error creating HTTP request", err)
+		return 0, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if fs.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 	resp, err := fs.httpClient.Do(req)
 	if err != nil {
-		fs.logger.CaptureFatalAndPanic("filestream: error making HTTP request", err)
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return statusCodeOf(resp), err
 	}
 	defer func(Body io.ReadCloser) {
 		if err = Body.Close(); err != nil {
 			fs.logger.CaptureError("filestream: error closing response body", err)
 		}
 	}(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("filestream: %s", resp.Status)
+	}
 
-	var res map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&res)
-	if err != nil {
+	res := &FsReply{}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
 		fs.logger.CaptureError("json decode error", err)
+		return resp.StatusCode, nil
 	}
 	fs.pushReply(res)
 	fs.logger.Debug("filestream: post response", "response", res)
+	return resp.StatusCode, nil
+}
+
+// gzipData compresses the body of a request
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// statusCodeOf returns the status code of a response, or 0 if there is none
+func statusCodeOf(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+// setDegraded records when sending requests starts failing and when it works
+// again, to report it to the user
+func (fs *FileStream) setDegraded(degraded bool, statusCode int, err error) {
+	fs.statusMutex.Lock()
+	defer fs.statusMutex.Unlock()
+	if fs.degraded == degraded {
+		return
+	}
+	fs.degraded = degraded
+
+	// the client shows the text of responses with no status as is, and the
+	// others as the status being retried
+	response := &service.HttpResponse{}
+	switch {
+	case !degraded:
+		response.HttpResponseText = "Network connection restored, resuming syncing run data."
+	case statusCode != 0:
+		response.HttpStatusCode = int32(statusCode)
+		response.HttpResponseText = http.StatusText(statusCode)
+	default:
+		response.HttpResponseText = fmt.Sprintf("Network error (%v), entering retry loop.", err)
+	}
+	fs.statusResponses = append(fs.statusResponses, response)
+}
+
+// NetworkStatus returns the changes of the network status since it was
+// last called
+func (fs *FileStream) NetworkStatus() []*service.HttpResponse {
+	fs.statusMutex.Lock()
+	defer fs.statusMutex.Unlock()
+	responses := fs.statusResponses
+	fs.statusResponses = nil
+	return responses
 }
 
 func (fs *FileStream) Close() {
@@ -397,6 +764,13 @@ func (fs *FileStream) Close() {
 	fs.recordWait.Wait()
 	close(fs.chunkChan)
 	fs.chunkWait.Wait()
+	// send what is left, unless the server can't be reached for too long
+	fs.spill.close()
+	timer := time.AfterFunc(fs.closeTimeout, fs.cancel)
+	fs.transmitWait.Wait()
+	timer.Stop()
+	fs.cancel()
+	fs.spill.release()
 	close(fs.replyChan)
 	fs.replyWait.Wait()
 	fs.logger.Debug("filestream: closed")
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+func TestFileStreamRequestSize(t *testing.T) {
+	const limit = 2048
+	mutex := sync.Mutex{}
+	lines := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		zr, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		body, err := io.ReadAll(zr)
+		assert.NoError(t, err)
+		// the server refuses requests over its limit, which is above the
+		// one of the file stream
+		if len(body) > 2*limit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		var data FsData
+		assert.NoError(t, json.Unmarshal(body, &data))
+		for name, chunk := range data.Files {
+			assert.Equal(t, len(lines[name]), chunk.Offset)
+			lines[name] = append(lines[name], chunk.Content...)
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	fs := NewFileStream(server.URL, &service.Settings{}, logger)
+	fs.maxRequestBytes = limit
+	fs.compress = true
+	fs.Start()
+
+	row := `{"x":"` + strings.Repeat("a", 100) + `"}`
+	for i := 0; i < 50; i++ {
+		fs.pushChunk(chunkData{fileName: HistoryFileName, fileData: &chunkLine{chunkType: historyChunk, line: row}})
+	}
+	// a json line too large for a request is sent alone
+	wide := `{"x":"` + strings.Repeat("b", limit) + `"}`
+	fs.pushChunk(chunkData{fileName: HistoryFileName, fileData: &chunkLine{chunkType: historyChunk, line: wide}})
+	fs.pushChunk(chunkData{fileName: HistoryFileName, fileData: &chunkLine{chunkType: historyChunk, line: row}})
+	// and so is an output line
+	long := strings.Repeat("é", limit/2)
+	fs.StreamOutputLines([]outputLine{{num: 0, text: "first"}, {num: 1, text: long}, {num: 2, text: "next"}})
+	fs.Close()
+
+	assert.Len(t, lines[HistoryFileName], 52)
+	for i, line := range lines[HistoryFileName] {
+		if i == 50 {
+			assert.Equal(t, wide, line)
+		} else {
+			assert.Equal(t, row, line)
+		}
+	}
+	assert.Equal(t, []string{"first", long, "next"}, lines[OutputFileName])
+}
+
+func TestFileStreamGzipFallback(t *testing.T) {
+	mutex := sync.Mutex{}
+	var lines []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		// a server that doesn't take compressed requests
+		if r.Header.Get("Content-Encoding") != "" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		var data FsData
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&data))
+		lines = append(lines, data.Files[OutputFileName].Content...)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	fs := NewFileStream(server.URL, &service.Settings{}, logger)
+	fs.compress = true
+	fs.Start()
+	fs.StreamOutputLines([]outputLine{{num: 0, text: "hello"}})
+	fs.Close()
+
+	assert.Equal(t, []string{"hello"}, lines)
+	assert.False(t, fs.compress)
+}
@@ -1,7 +1,9 @@
 package server_test
 
 import (
+	"compress/gzip"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/wandb/wandb/nexus/pkg/observability"
@@ -72,7 +74,16 @@ func (h apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	m["name"] = "mock"
 
 	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
-	dec := json.NewDecoder(r.Body)
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			fmt.Println("ERROR", err)
+			return
+		}
+		body = zr
+	}
+	dec := json.NewDecoder(body)
 	var msg server.FsData
 	err := dec.Decode(&msg)
 	if err != nil {
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wandb/wandb/nexus/pkg/observability"
+)
+
+const (
+	// liveFilePollInterval is how often live files are checked for changes
+	liveFilePollInterval = time.Second
+
+	// liveFileDebounce is how long a live file must stay unchanged before it
+	// is uploaded again, so a file being written is not uploaded many times
+	liveFileDebounce = 5 * time.Second
+)
+
+// liveFiles watches the files saved with the live policy and hands them to
+// the sender to upload again when they change
+type liveFiles struct {
+	// filesDir is the dir the file names are relative to
+	filesDir string
+
+	// logger is the logger for the live files
+	logger *observability.NexusLogger
+
+	// changed receives the names of the files to upload again, the sender
+	// reads it in its loop
+	changed chan string
+
+	// interval is how often the files are checked
+	interval time.Duration
+
+	// debounce is how long a file must be unchanged before it is uploaded
+	debounce time.Duration
+
+	// mutex protects files
+	mutex sync.Mutex
+
+	// files are the watched files by name
+	files map[string]*liveFile
+
+	// done is closed to stop watching
+	done chan struct{}
+
+	// wg is the wait group for the watching goroutine
+	wg sync.WaitGroup
+
+	// started and stopped are whether the watching was started and stopped
+	started bool
+	stopped bool
+}
+
+// liveFile is the state of a watched file
+type liveFile struct {
+	// modTime and size are the file when it was last checked
+	modTime time.Time
+	size    int64
+
+	// changed is when the file was last seen changing, it is zero once the
+	// change was uploaded
+	changed time.Time
+}
+
+func newLiveFiles(filesDir string, logger *observability.NexusLogger) *liveFiles {
+	return &liveFiles{
+		filesDir: filesDir,
+		logger:   logger,
+		changed:  make(chan string),
+		interval: liveFilePollInterval,
+		debounce: liveFileDebounce,
+		files:    make(map[string]*liveFile),
+		done:     make(chan struct{}),
+	}
+}
+
+// add starts watching a file that was just uploaded
+func (lf *liveFiles) add(name string) {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	if lf.stopped {
+		return
+	}
+	if _, ok := lf.files[name]; ok {
+		return
+	}
+	file := &liveFile{}
+	if info, err := os.Stat(filepath.Join(lf.filesDir, name)); err == nil {
+		file.modTime, file.size = info.ModTime(), info.Size()
+	}
+	lf.files[name] = file
+
+	if !lf.started {
+		lf.started = true
+		lf.wg.Add(1)
+		go func() {
+			defer lf.wg.Done()
+			lf.watch()
+		}()
+	}
+}
+
+func (lf *liveFiles) watch() {
+	ticker := time.NewTicker(lf.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, name := range lf.check(now) {
+				// files not handed over before stop are uploaded by stop
+				select {
+				case lf.changed <- name:
+				case <-lf.done:
+					return
+				}
+			}
+		case <-lf.done:
+			return
+		}
+	}
+}
+
+// check returns the files that changed and have been unchanged since for
+// longer than the debounce
+func (lf *liveFiles) check(now time.Time) []string {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+
+	var names []string
+	for name, file := range lf.files {
+		info, err := os.Stat(filepath.Join(lf.filesDir, name))
+		if err != nil {
+			// the file may not have been written yet or is being replaced
+			continue
+		}
+		if !info.ModTime().Equal(file.modTime) || info.Size() != file.size {
+			file.modTime, file.size = info.ModTime(), info.Size()
+			file.changed = now
+			continue
+		}
+		if !file.changed.IsZero() && now.Sub(file.changed) >= lf.debounce {
+			file.changed = time.Time{}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// stop stops watching the files and returns the names of all of them, so
+// that their final versions can be uploaded
+func (lf *liveFiles) stop() []string {
+	lf.mutex.Lock()
+	if lf.stopped {
+		lf.mutex.Unlock()
+		return nil
+	}
+	lf.stopped = true
+	lf.mutex.Unlock()
+
+	close(lf.done)
+	lf.wg.Wait()
+
+	names := make([]string, 0, len(lf.files))
+	for name := range lf.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+)
+
+func TestLiveFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "model.ckpt")
+	assert.NoError(t, os.WriteFile(path, []byte("v1"), 0644))
+
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	lf := newLiveFiles(dir, logger)
+	lf.add("model.ckpt")
+	now := time.Now()
+
+	// unchanged files are not uploaded
+	assert.Empty(t, lf.check(now))
+
+	// changed files are uploaded once they stop changing
+	assert.NoError(t, os.WriteFile(path, []byte("v2 "), 0644))
+	assert.Empty(t, lf.check(now.Add(time.Second)))
+	assert.NoError(t, os.WriteFile(path, []byte("v3 longer"), 0644))
+	assert.Empty(t, lf.check(now.Add(2*time.Second)))
+	assert.Empty(t, lf.check(now.Add(2*time.Second+lf.debounce/2)))
+	assert.Equal(t, []string{"model.ckpt"}, lf.check(now.Add(2*time.Second+lf.debounce)))
+	assert.Empty(t, lf.check(now.Add(3*time.Second+lf.debounce)))
+
+	assert.Equal(t, []string{"model.ckpt"}, lf.stop())
+}
+
+func TestLiveFilesUpload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "log.txt")
+	assert.NoError(t, os.WriteFile(path, []byte("a"), 0644))
+
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	lf := newLiveFiles(dir, logger)
+	lf.interval = 10 * time.Millisecond
+	lf.debounce = 30 * time.Millisecond
+	lf.add("log.txt")
+
+	assert.NoError(t, os.WriteFile(path, []byte("ab"), 0644))
+	select {
+	case name := <-lf.changed:
+		assert.Equal(t, "log.txt", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("live file was not uploaded")
+	}
+	assert.Equal(t, []string{"log.txt"}, lf.stop())
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/wandb/wandb/nexus/pkg/monitor"
 
@@ -42,9 +43,20 @@ type Handler struct {
 	// from the server
 	runRecord *service.RunRecord
 
+	// runStatus is the progress of the run published by the sender
+	runStatus *runStatus
+
 	// consolidatedSummary is the full summary (all keys)
-	// TODO(memory): persist this in the future as it will grow with number of distinct keys
-	consolidatedSummary map[string]string
+	consolidatedSummary StateStore
+
+	// metricHandler tracks the metrics defined by the run
+	metricHandler *metricHandler
+
+	// sampledHistory is a sample of the history of each numeric key
+	sampledHistory map[string]*historySample
+
+	// tbHandler turns the tensorboard events of the run into history
+	tbHandler *TBHandler
 
 	// historyRecord is the history record used to track
 	// current active history record for the stream
@@ -67,7 +79,10 @@ func NewHandler(
 		settings:            settings,
 		logger:              logger,
 		systemMonitor:       systemMonitor,
-		consolidatedSummary: make(map[string]string),
+		consolidatedSummary: NewStateStore(settings, "summary", logger),
+		metricHandler:       newMetricHandler(),
+		sampledHistory:      make(map[string]*historySample),
+		tbHandler:           NewTBHandler(settings, logger),
 		recordChan:          make(chan *service.Record, BufferSize),
 		resultChan:          make(chan *service.Result, BufferSize),
 	}
@@ -79,8 +94,17 @@ func (h *Handler) do(inChan <-chan *service.Record) {
 	defer observability.Reraise()
 
 	h.logger.Info("handler: started", "stream_id", h.settings.RunId)
-	for record := range inChan {
-		h.handleRecord(record)
+	for inChan != nil {
+		select {
+		case record, ok := <-inChan:
+			if !ok {
+				inChan = nil
+				continue
+			}
+			h.handleRecord(record)
+		case record := <-h.tbHandler.recordChan:
+			h.handleRecord(record)
+		}
 	}
 	h.close()
 	h.logger.Debug("handler: closed", "stream_id", h.settings.RunId)
@@ -96,6 +120,8 @@ func (h *Handler) sendResponse(record *service.Record, response *service.Respons
 }
 
 func (h *Handler) close() {
+	h.tbHandler.Close()
+	h.consolidatedSummary.Close()
 	close(h.resultChan)
 	close(h.recordChan)
 }
@@ -126,8 +152,10 @@ func (h *Handler) handleRecord(record *service.Record) {
 	case *service.Record_Footer:
 	case *service.Record_Header:
 	case *service.Record_History:
+		h.handleHistory(record, x.History)
 	case *service.Record_LinkArtifact:
 	case *service.Record_Metric:
+		h.handleMetric(record, x.Metric)
 	case *service.Record_Output:
 	case *service.Record_OutputRaw:
 		h.handleOutputRaw(record)
@@ -141,6 +169,7 @@ func (h *Handler) handleRecord(record *service.Record) {
 	case *service.Record_Summary:
 		h.handleSummary(record, x.Summary)
 	case *service.Record_Tbrecord:
+		h.handleTBRecord(record, x.Tbrecord)
 	case *service.Record_Telemetry:
 		h.handleTelemetry(record)
 	case nil:
@@ -163,16 +192,20 @@ func (h *Handler) handleRequest(record *service.Record) {
 		h.handleGetSummary(record, response)
 	case *service.Request_Keepalive:
 	case *service.Request_NetworkStatus:
+		h.handleNetworkStatus(response)
 	case *service.Request_PartialHistory:
 		h.handlePartialHistory(record, x.PartialHistory)
 		return
 	case *service.Request_PollExit:
+		h.handlePollExit(response)
 	case *service.Request_RunStart:
 		h.handleRunStart(record, x.RunStart)
 	case *service.Request_SampledHistory:
+		h.handleSampledHistory(record, response)
 	case *service.Request_ServerInfo:
 	case *service.Request_Shutdown:
 	case *service.Request_StopStatus:
+		h.handleStopStatus(response)
 	case *service.Request_LogArtifact:
 		h.handleLogArtifact(record, x.LogArtifact, response)
 	case *service.Request_JobInfo:
@@ -193,7 +226,16 @@ func (h *Handler) handleDefer(record *service.Record) {
 	case service.DeferRequest_FLUSH_STATS:
 	case service.DeferRequest_FLUSH_PARTIAL_HISTORY:
 		h.flushHistory(h.historyRecord)
+		if len(h.historyRecord.GetItem()) > 0 {
+			// the rows still coming, like the tensorboard ones, come after it
+			h.historyRecord = &service.HistoryRecord{
+				Step: &service.HistoryStep{Num: h.historyRecord.Step.Num + 1},
+			}
+		}
 	case service.DeferRequest_FLUSH_TB:
+		for _, tbRecord := range h.tbHandler.Finish() {
+			h.handleRecord(tbRecord)
+		}
 	case service.DeferRequest_FLUSH_SUM:
 	case service.DeferRequest_FLUSH_DEBOUNCER:
 	case service.DeferRequest_FLUSH_OUTPUT:
@@ -307,16 +349,102 @@ func (h *Handler) handleExit(record *service.Record) {
 	h.sendRecord(record)
 }
 
+// handleMetric tracks the metric definition and passes it on, the sender
+// adds the metrics to the run config
+func (h *Handler) handleMetric(record *service.Record, metric *service.MetricRecord) {
+	switch {
+	case metric.GlobName != "":
+		h.metricHandler.addGlob(metric)
+	case metric.Name != "":
+		if step := h.metricHandler.addMetric(metric); step != nil {
+			// the step metric has to be defined before the metric using it
+			h.sendDerivedMetric(step)
+		}
+	default:
+		return
+	}
+	h.sendRecord(record)
+}
+
+// sendDerivedMetric sends a metric the handler defined itself. It is stored
+// like the user's metrics, as a synced log goes straight to the sender.
+func (h *Handler) sendDerivedMetric(metric *service.MetricRecord) {
+	record := &service.Record{
+		RecordType: &service.Record_Metric{Metric: metric},
+	}
+	h.sendRecord(record)
+}
+
+func (h *Handler) handleTBRecord(record *service.Record, tbRecord *service.TBRecord) {
+	h.tbHandler.Handle(tbRecord)
+	h.sendRecord(record)
+}
+
 func (h *Handler) handleFiles(record *service.Record) {
 	h.sendRecord(record)
 }
 
+// sampleHistory adds the numeric values of the history to the samples of
+// their keys, internal keys like _step are not sampled
+func (h *Handler) sampleHistory(items []*service.HistoryItem) {
+	for _, item := range items {
+		if len(item.NestedKey) > 0 || strings.HasPrefix(item.Key, "_") {
+			continue
+		}
+		sample, ok := h.sampledHistory[item.Key]
+		if !ok {
+			sample = &historySample{}
+			h.sampledHistory[item.Key] = sample
+		}
+		sample.add(item.ValueJson)
+	}
+}
+
+func (h *Handler) handleSampledHistory(_ *service.Record, response *service.Response) {
+	var items []*service.SampledHistoryItem
+	for key, sample := range h.sampledHistory {
+		if len(sample.values) == 0 {
+			continue
+		}
+		floats, ints := sample.get()
+		items = append(items, &service.SampledHistoryItem{Key: key, ValuesFloat: floats, ValuesInt: ints})
+	}
+	response.ResponseType = &service.Response_SampledHistoryResponse{
+		SampledHistoryResponse: &service.SampledHistoryResponse{
+			Item: items,
+		},
+	}
+}
+
+// handlePollExit responds with the progress of the uploads the sender
+// published, the sender may be done and no longer reading requests
+func (h *Handler) handlePollExit(response *service.Response) {
+	response.ResponseType = &service.Response_PollExitResponse{
+		PollExitResponse: h.runStatus.pollExit(),
+	}
+}
+
+// handleNetworkStatus responds with the problems the sender ran into
+func (h *Handler) handleNetworkStatus(response *service.Response) {
+	response.ResponseType = &service.Response_NetworkStatusResponse{
+		NetworkStatusResponse: h.runStatus.networkStatusResponse(),
+	}
+}
+
+// handleStopStatus responds with whether the server asked the run to stop
+func (h *Handler) handleStopStatus(response *service.Response) {
+	response.ResponseType = &service.Response_StopStatusResponse{
+		StopStatusResponse: h.runStatus.stopStatus(),
+	}
+}
+
 func (h *Handler) handleGetSummary(_ *service.Record, response *service.Response) {
 	var items []*service.SummaryItem
 
-	for key, element := range h.consolidatedSummary {
-		items = append(items, &service.SummaryItem{Key: key, ValueJson: element})
-	}
+	h.consolidatedSummary.Range(func(key string, value string) bool {
+		items = append(items, &service.SummaryItem{Key: key, ValueJson: value})
+		return true
+	})
 	response.ResponseType = &service.Response_GetSummaryResponse{
 		GetSummaryResponse: &service.GetSummaryResponse{
 			Item: items,
@@ -349,14 +477,45 @@ func (h *Handler) flushHistory(history *service.HistoryRecord) {
 		&service.HistoryItem{Key: "_step", ValueJson: fmt.Sprintf("%d", history.GetStep().GetNum())},
 	)
 
+	var summaryRecord *service.Record
+	var err error
+	if h.metricHandler.enabled() {
+		stepItems, metrics := h.metricHandler.stepItems(history.Item)
+		for _, metric := range metrics {
+			h.sendDerivedMetric(metric)
+		}
+		history.Item = append(history.Item, stepItems...)
+		summaryItems := h.metricHandler.summaryItems(history.Item)
+		summaryRecord, err = nexuslib.ConsolidateSummaryItems(h.consolidatedSummary, summaryItems, nil)
+	} else {
+		summaryRecord, err = nexuslib.ConsolidateSummaryItems(h.consolidatedSummary, history.Item, nil)
+	}
+	if err != nil {
+		h.logger.CaptureError("error updating summary from history", err)
+	}
+	h.sampleHistory(history.Item)
+
 	record := &service.Record{
 		RecordType: &service.Record_History{History: history},
 	}
-	summaryRecord := nexuslib.ConsolidateSummaryItems(h.consolidatedSummary, history.Item)
 	h.sendRecord(summaryRecord)
 	h.sendRecord(record)
 }
 
+// handleHistory handles a whole history row, like the ones read from the
+// tensorboard event files. It takes the step of the partial row the run is
+// logging, which moves on to the next step, like the python client does.
+func (h *Handler) handleHistory(_ *service.Record, history *service.HistoryRecord) {
+	if h.historyRecord == nil {
+		h.historyRecord = &service.HistoryRecord{
+			Step: &service.HistoryStep{Num: h.runRecord.GetStartingStep()},
+		}
+	}
+	history.Step = &service.HistoryStep{Num: h.historyRecord.Step.Num}
+	h.historyRecord.Step.Num++
+	h.flushHistory(history)
+}
+
 func (h *Handler) handlePartialHistory(_ *service.Record, request *service.PartialHistoryRequest) {
 
 	// This is the first partial history record we receive
@@ -433,7 +592,10 @@ func (h *Handler) handleTelemetry(record *service.Record) {
 }
 
 func (h *Handler) handleSummary(record *service.Record, summary *service.SummaryRecord) {
-	summaryRecord := nexuslib.ConsolidateSummaryItems(h.consolidatedSummary, summary.Update)
+	summaryRecord, err := nexuslib.ConsolidateSummaryItems(h.consolidatedSummary, summary.Update, summary.Remove)
+	if err != nil {
+		h.logger.CaptureError("error updating summary", err)
+	}
 	h.sendRecord(summaryRecord)
 }
 
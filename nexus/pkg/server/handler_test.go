@@ -0,0 +1,293 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/internal/uploader"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+func makeHandler() *Handler {
+	return &Handler{
+		logger:              observability.NewNexusLogger(SetupDefaultLogger(), nil),
+		settings:            &service.Settings{},
+		consolidatedSummary: NewMemoryStateStore(),
+		metricHandler:       newMetricHandler(),
+		sampledHistory:      make(map[string]*historySample),
+		recordChan:          make(chan *service.Record, BufferSize),
+		resultChan:          make(chan *service.Result, BufferSize),
+	}
+}
+
+func TestHandleSummaryNested(t *testing.T) {
+	h := makeHandler()
+	h.handleSummary(nil, &service.SummaryRecord{
+		Update: []*service.SummaryItem{
+			{Key: "loss", ValueJson: "0.5"},
+			{Key: "tmp", ValueJson: `"x"`},
+			{Key: "eval", ValueJson: `{"acc": 0.1, "f1": 0.2}`},
+		},
+	})
+	<-h.recordChan
+
+	h.handleSummary(nil, &service.SummaryRecord{
+		Update: []*service.SummaryItem{
+			{NestedKey: []string{"eval", "acc"}, ValueJson: "0.9"},
+		},
+		Remove: []*service.SummaryItem{
+			{Key: "tmp"},
+			{NestedKey: []string{"eval", "f1"}},
+			{Key: "missing"},
+		},
+	})
+	record := <-h.recordChan
+	summary := record.GetSummary()
+	assert.Len(t, summary.Update, 1)
+	assert.Equal(t, "eval", summary.Update[0].Key)
+	assert.JSONEq(t, `{"acc": 0.9}`, summary.Update[0].ValueJson)
+	assert.Len(t, summary.Remove, 1)
+	assert.Equal(t, "tmp", summary.Remove[0].Key)
+
+	response := &service.Response{}
+	h.handleGetSummary(nil, response)
+	items := make(map[string]string)
+	for _, item := range response.GetGetSummaryResponse().GetItem() {
+		items[item.Key] = item.ValueJson
+	}
+	assert.Len(t, items, 2)
+	assert.Equal(t, "0.5", items["loss"])
+	assert.JSONEq(t, `{"acc": 0.9}`, items["eval"])
+}
+
+func TestHandleMetric(t *testing.T) {
+	h := makeHandler()
+	handleMetric := func(metric *service.MetricRecord) {
+		h.handleRecord(&service.Record{RecordType: &service.Record_Metric{Metric: metric}})
+	}
+	handleMetric(&service.MetricRecord{
+		Name:       "loss",
+		StepMetric: "epoch",
+		Options:    &service.MetricOptions{StepSync: true},
+		Summary:    &service.MetricSummary{Min: true, Mean: true},
+	})
+	// the step metric is defined first
+	assert.Equal(t, "epoch", (<-h.recordChan).GetMetric().GetName())
+	assert.Equal(t, "loss", (<-h.recordChan).GetMetric().GetName())
+	handleMetric(&service.MetricRecord{
+		GlobName: "val/*",
+		Goal:     service.MetricRecord_GOAL_MAXIMIZE,
+		Summary:  &service.MetricSummary{Best: true},
+	})
+	<-h.recordChan
+
+	flush := func(step int64, items ...*service.HistoryItem) (map[string]string, map[string]string) {
+		h.flushHistory(&service.HistoryRecord{Step: &service.HistoryStep{Num: step}, Item: items})
+		history := make(map[string]string)
+		summary := make(map[string]string)
+		for record := range h.recordChan {
+			switch x := record.RecordType.(type) {
+			case *service.Record_History:
+				for _, item := range x.History.Item {
+					history[item.Key] = item.ValueJson
+				}
+				h.consolidatedSummary.Range(func(key string, value string) bool {
+					summary[key] = value
+					return true
+				})
+				return history, summary
+			case *service.Record_Metric:
+				assert.False(t, record.GetControl().GetLocal())
+			}
+		}
+		return history, summary
+	}
+
+	_, summary := flush(0, &service.HistoryItem{Key: "epoch", ValueJson: "1"},
+		&service.HistoryItem{Key: "loss", ValueJson: "2"},
+		&service.HistoryItem{Key: "val/acc", ValueJson: "0.5"},
+		&service.HistoryItem{Key: "lr", ValueJson: "0.1"},
+	)
+	assert.Equal(t, "1", summary["epoch"])
+	assert.Equal(t, "0.1", summary["lr"])
+	assert.JSONEq(t, `{"min": 2, "mean": 2}`, summary["loss"])
+	assert.JSONEq(t, `{"best": 0.5}`, summary["val/acc"])
+
+	history, summary := flush(1, &service.HistoryItem{Key: "loss", ValueJson: "1"},
+		&service.HistoryItem{Key: "val/acc", ValueJson: "0.4"},
+	)
+	// the last epoch is added to the history of the loss
+	assert.Equal(t, "1", history["epoch"])
+	assert.JSONEq(t, `{"min": 1, "mean": 1.5}`, summary["loss"])
+	assert.JSONEq(t, `{"best": 0.5}`, summary["val/acc"])
+
+	// the glob defined first wins
+	handleMetric(&service.MetricRecord{GlobName: "v*", Summary: &service.MetricSummary{Min: true}})
+	<-h.recordChan
+	// non-finite values are left out of the summary
+	_, summary = flush(2, &service.HistoryItem{Key: "loss", ValueJson: "Infinity"},
+		&service.HistoryItem{Key: "val/loss", ValueJson: "0.3"},
+	)
+	assert.JSONEq(t, `{"min": 1, "mean": 1.5}`, summary["loss"])
+	assert.JSONEq(t, `{"best": 0.3}`, summary["val/loss"])
+}
+
+func TestHandleHistory(t *testing.T) {
+	h := makeHandler()
+	h.runRecord = &service.RunRecord{}
+	h.handlePartialHistory(nil, &service.PartialHistoryRequest{
+		Item:   []*service.HistoryItem{{Key: "loss", ValueJson: "1"}},
+		Action: &service.HistoryAction{Flush: false},
+	})
+	// a row read from tensorboard is not merged into the partial row
+	h.handleRecord(&service.Record{RecordType: &service.Record_History{History: &service.HistoryRecord{
+		Item: []*service.HistoryItem{{Key: "train/acc", ValueJson: "0.5"}}}}})
+	<-h.recordChan
+	history := (<-h.recordChan).GetHistory()
+	assert.Equal(t, int64(0), history.GetStep().GetNum())
+	for _, item := range history.Item {
+		assert.NotEqual(t, "loss", item.Key)
+	}
+
+	h.handlePartialHistory(nil, &service.PartialHistoryRequest{})
+	<-h.recordChan
+	history = (<-h.recordChan).GetHistory()
+	assert.Equal(t, int64(1), history.GetStep().GetNum())
+	assert.Equal(t, "loss", history.Item[0].Key)
+}
+
+func TestHandleSampledHistory(t *testing.T) {
+	h := makeHandler()
+	num := 1000
+	for i := 0; i < num; i++ {
+		h.flushHistory(&service.HistoryRecord{
+			Step: &service.HistoryStep{Num: int64(i)},
+			Item: []*service.HistoryItem{
+				{Key: "epoch", ValueJson: fmt.Sprintf("%d", i)},
+				{Key: "acc", ValueJson: fmt.Sprintf("%d.5", i)},
+				{Key: "name", ValueJson: `"text"`},
+			},
+		})
+		<-h.recordChan
+		<-h.recordChan
+	}
+
+	response := &service.Response{}
+	h.handleSampledHistory(nil, response)
+	items := make(map[string]*service.SampledHistoryItem)
+	for _, item := range response.GetSampledHistoryResponse().GetItem() {
+		items[item.Key] = item
+	}
+	assert.Len(t, items, 2)
+
+	epochs := items["epoch"].ValuesInt
+	assert.Len(t, epochs, historySampleSize)
+	assert.Empty(t, items["epoch"].ValuesFloat)
+	for i := 1; i < len(epochs); i++ {
+		assert.Less(t, epochs[i-1], epochs[i])
+	}
+	assert.Len(t, items["acc"].ValuesFloat, historySampleSize)
+}
+
+func TestHandlePollExitAfterEnd(t *testing.T) {
+	sender := makeSender(nil, make(chan *service.Result, 1))
+	sender.recordChan = make(chan *service.Record, 1)
+	h := makeHandler()
+	h.runStatus = sender.status
+	pollExit := &service.Record{RecordType: &service.Record_Request{Request: &service.Request{
+		RequestType: &service.Request_PollExit{PollExit: &service.PollExitRequest{}}}}}
+
+	h.handleRecord(pollExit)
+	response := (<-h.resultChan).GetResponse().GetPollExitResponse()
+	assert.False(t, response.Done)
+	assert.Nil(t, response.ExitResult)
+	assert.NotNil(t, response.PusherStats)
+
+	// the sender closes its channels at the end, the client still polls
+	sender.status.finish()
+	sender.sendDefer(&service.DeferRequest{State: service.DeferRequest_END})
+	h.handleRecord(pollExit)
+	response = (<-h.resultChan).GetResponse().GetPollExitResponse()
+	assert.True(t, response.Done)
+	assert.NotNil(t, response.ExitResult)
+}
+
+func TestHandleNetworkStatusUploadFailures(t *testing.T) {
+	sender := makeSender(nil, make(chan *service.Result, 1))
+	sender.recordChan = make(chan *service.Record, 1)
+	h := makeHandler()
+	h.runStatus = sender.status
+	sender.uploadComplete("model.ckpt", &uploader.UploadResult{Path: "/run/files/model.ckpt", Err: errors.New("403 Forbidden")})
+	sender.uploadComplete("ok.txt", &uploader.UploadResult{Path: "/run/files/ok.txt"})
+
+	// the uploads at the end of the run fail after the sender is done
+	sender.sendDefer(&service.DeferRequest{State: service.DeferRequest_END})
+
+	record := &service.Record{RecordType: &service.Record_Request{Request: &service.Request{
+		RequestType: &service.Request_NetworkStatus{NetworkStatus: &service.NetworkStatusRequest{}}}}}
+	h.handleRecord(record)
+	responses := (<-h.resultChan).GetResponse().GetNetworkStatusResponse().GetNetworkResponses()
+	assert.Len(t, responses, 1)
+	assert.Equal(t, "Failed to upload model.ckpt: 403 Forbidden", responses[0].HttpResponseText)
+
+	// failures are only reported once, but all of them are kept
+	h.handleRecord(record)
+	assert.Empty(t, (<-h.resultChan).GetResponse().GetNetworkStatusResponse().GetNetworkResponses())
+	assert.Equal(t, []string{"model.ckpt"}, sender.status.failed())
+}
+
+func TestHandleNetworkStatusRetries(t *testing.T) {
+	failures := 3
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	h := makeHandler()
+	h.runStatus = newRunStatus()
+	client := newRetryClient("", h.logger, h.runStatus.networkStatus)
+	client.RetryWaitMin = time.Millisecond
+	client.RetryWaitMax = time.Millisecond
+	resp, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+
+	record := &service.Record{RecordType: &service.Record_Request{Request: &service.Request{
+		RequestType: &service.Request_NetworkStatus{NetworkStatus: &service.NetworkStatusRequest{}}}}}
+	h.handleRecord(record)
+	responses := (<-h.resultChan).GetResponse().GetNetworkStatusResponse().GetNetworkResponses()
+	// the same retry is only reported once
+	assert.Len(t, responses, 1)
+	assert.Equal(t, int32(http.StatusTooManyRequests), responses[0].HttpStatusCode)
+	assert.Equal(t, "Too Many Requests", responses[0].HttpResponseText)
+
+	h.handleRecord(record)
+	assert.Empty(t, (<-h.resultChan).GetResponse().GetNetworkStatusResponse().GetNetworkResponses())
+}
+
+func TestHandleStopStatusAfterEnd(t *testing.T) {
+	sender := makeSender(nil, make(chan *service.Result, 1))
+	sender.recordChan = make(chan *service.Record, 1)
+	sender.fileStream = NewFileStream("", sender.settings, sender.logger)
+	sender.status.start(nil, sender.fileStream, nil)
+	h := makeHandler()
+	h.runStatus = sender.status
+
+	exitCode := int32(0)
+	sender.fileStream.handleReply(&FsReply{Exitcode: &exitCode})
+	sender.sendDefer(&service.DeferRequest{State: service.DeferRequest_END})
+
+	record := &service.Record{RecordType: &service.Record_Request{Request: &service.Request{
+		RequestType: &service.Request_StopStatus{StopStatus: &service.StopStatusRequest{}}}}}
+	h.handleRecord(record)
+	assert.True(t, (<-h.resultChan).GetResponse().GetStopStatusResponse().GetRunShouldStop())
+}
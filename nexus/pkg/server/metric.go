@@ -0,0 +1,340 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/wandb/wandb/nexus/internal/nexuslib"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+// metricHandler tracks the metrics defined with define_metric, to add
+// step metrics to the history and derived values like the min to the summary
+type metricHandler struct {
+	// defined are the metrics defined by name
+	defined map[string]*service.MetricRecord
+
+	// globs are the metrics defined by glob name, in the order they were
+	// first defined
+	globs []*service.MetricRecord
+
+	// stepMetrics are the names of the step metrics of the defined metrics
+	stepMetrics map[string]bool
+
+	// stepValues are the last values (json) logged for the step metrics
+	stepValues map[string]string
+
+	// track are the values the summaries are derived from, by metric key
+	// and summary, e.g. the current max or the total for the mean
+	track map[string]float64
+}
+
+func newMetricHandler() *metricHandler {
+	return &metricHandler{
+		defined:     make(map[string]*service.MetricRecord),
+		stepMetrics: make(map[string]bool),
+		stepValues:  make(map[string]string),
+		track:       make(map[string]float64),
+	}
+}
+
+// enabled returns whether any metric has been defined
+func (mh *metricHandler) enabled() bool {
+	return len(mh.defined) > 0 || len(mh.globs) > 0
+}
+
+// addGlob adds or merges a metric defined by glob name, a glob defined
+// again keeps its place
+func (mh *metricHandler) addGlob(metric *service.MetricRecord) {
+	for i, glob := range mh.globs {
+		if glob.GlobName == metric.GlobName {
+			mh.globs[i] = mergeMetric(glob, metric)
+			return
+		}
+	}
+	mh.globs = append(mh.globs, mergeMetric(nil, metric))
+}
+
+// addMetric adds or merges a metric defined by name. If its step metric is not
+// defined yet it is defined as well, and returned so that it can be sent.
+func (mh *metricHandler) addMetric(metric *service.MetricRecord) *service.MetricRecord {
+	metric = mergeMetric(mh.defined[metric.Name], metric)
+	mh.defined[metric.Name] = metric
+	if metric.StepMetric == "" {
+		return nil
+	}
+	mh.stepMetrics[metric.StepMetric] = true
+	if _, ok := mh.defined[metric.StepMetric]; ok {
+		return nil
+	}
+	step := &service.MetricRecord{Name: metric.StepMetric}
+	mh.defined[step.Name] = step
+	return step
+}
+
+func mergeMetric(old *service.MetricRecord, metric *service.MetricRecord) *service.MetricRecord {
+	if old == nil || metric.GetXControl().GetOverwrite() {
+		return proto.Clone(metric).(*service.MetricRecord)
+	}
+	proto.Merge(old, metric)
+	return old
+}
+
+// matchGlob returns a metric defined from the first glob matching the history
+// key in the order they were defined, like the python client does, or nil if
+// there is none. Internal keys never match.
+func (mh *metricHandler) matchGlob(key string) *service.MetricRecord {
+	if strings.HasPrefix(key, "_") {
+		return nil
+	}
+	for _, glob := range mh.globs {
+		if strings.HasSuffix(glob.GlobName, "*") && strings.HasPrefix(key, strings.TrimSuffix(glob.GlobName, "*")) {
+			metric := proto.Clone(glob).(*service.MetricRecord)
+			metric.GlobName = ""
+			metric.Name = key
+			if metric.Options != nil {
+				metric.Options.Defined = false
+			}
+			return metric
+		}
+	}
+	return nil
+}
+
+// metricKey returns the name a metric at path is defined with, the keys are
+// joined by dots and dots in the keys are escaped
+func metricKey(path []string) string {
+	keys := make([]string, len(path))
+	for i, key := range path {
+		keys[i] = strings.ReplaceAll(key, ".", "\\.")
+	}
+	return strings.Join(keys, ".")
+}
+
+// parseValue parses a history value, accepting the non-finite numbers the
+// python client writes
+func parseValue(valueJson string) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal([]byte(valueJson), &value)
+	if err == nil {
+		return value, nil
+	}
+	switch valueJson {
+	case "NaN":
+		return math.NaN(), nil
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	}
+	return nil, err
+}
+
+// isWandbDict returns whether a value is a wandb object like an image or a
+// table, which are leaves rather than nested keys
+func isWandbDict(value map[string]interface{}) bool {
+	_, ok := value["_type"]
+	return ok
+}
+
+// historyLeaf is a value in the history, nested values are split in leaves
+type historyLeaf struct {
+	path      []string
+	value     interface{}
+	valueJson string
+}
+
+// historyLeaves returns the leaves of the history items
+func historyLeaves(items []*service.HistoryItem) []historyLeaf {
+	var leaves []historyLeaf
+	var walk func(path []string, value interface{}, valueJson string)
+	walk = func(path []string, value interface{}, valueJson string) {
+		if dict, ok := value.(map[string]interface{}); ok && !isWandbDict(dict) {
+			for key, child := range dict {
+				walk(append(path[:len(path):len(path)], key), child, "")
+			}
+			return
+		}
+		leaves = append(leaves, historyLeaf{path: path, value: value, valueJson: valueJson})
+	}
+	for _, item := range items {
+		path := nexuslib.KeyPath(item.GetKey(), item.GetNestedKey())
+		value, err := parseValue(item.GetValueJson())
+		if err != nil {
+			// keep values we can't parse as they are
+			leaves = append(leaves, historyLeaf{path: path, valueJson: item.GetValueJson()})
+			continue
+		}
+		walk(path, value, item.GetValueJson())
+	}
+	return leaves
+}
+
+// leafMetric returns the metric defined for a history leaf, defining it from
+// a glob if needed. The metrics defined from globs are returned in created.
+func (mh *metricHandler) leafMetric(leaf historyLeaf, created *[]*service.MetricRecord) *service.MetricRecord {
+	key := metricKey(leaf.path)
+	if metric, ok := mh.defined[key]; ok {
+		return metric
+	}
+	metric := mh.matchGlob(key)
+	if metric == nil {
+		return nil
+	}
+	*created = append(*created, metric)
+	if step := mh.addMetric(metric); step != nil {
+		*created = append(*created, step)
+	}
+	return metric
+}
+
+// stepItems returns the values of the step metrics to add to the history for
+// the metrics in it that are synced with their step metric, and the metrics
+// that had to be defined from globs
+func (mh *metricHandler) stepItems(items []*service.HistoryItem) ([]*service.HistoryItem, []*service.MetricRecord) {
+	keys := make(map[string]bool)
+	for _, item := range items {
+		keys[item.GetKey()] = true
+	}
+	var created []*service.MetricRecord
+	var stepItems []*service.HistoryItem
+	for _, leaf := range historyLeaves(items) {
+		metric := mh.leafMetric(leaf, &created)
+		if metric == nil || !metric.GetOptions().GetStepSync() || metric.StepMetric == "" {
+			continue
+		}
+		if keys[metric.StepMetric] {
+			continue
+		}
+		if value, ok := mh.stepValues[metric.StepMetric]; ok {
+			keys[metric.StepMetric] = true
+			stepItems = append(stepItems, &service.HistoryItem{Key: metric.StepMetric, ValueJson: value})
+		}
+	}
+	return stepItems, created
+}
+
+// summaryItems returns the summary updates for the history items. Values are
+// copied to the summary unless their metric defines other summaries, which
+// are added under the key of the value, e.g. "loss.min".
+func (mh *metricHandler) summaryItems(items []*service.HistoryItem) []*service.SummaryItem {
+	for _, item := range items {
+		if len(item.GetNestedKey()) == 0 && mh.stepMetrics[item.GetKey()] {
+			mh.stepValues[item.GetKey()] = item.GetValueJson()
+		}
+	}
+
+	var summaryItems []*service.SummaryItem
+	for _, leaf := range historyLeaves(items) {
+		// the metric of a nested value is inherited from the closest parent
+		var metric *service.MetricRecord
+		for i := len(leaf.path); i > 0 && metric == nil; i-- {
+			metric = mh.defined[metricKey(leaf.path[:i])]
+		}
+		summaryItems = append(summaryItems, mh.leafSummaryItems(leaf, metric)...)
+	}
+	return summaryItems
+}
+
+func (mh *metricHandler) leafSummaryItems(leaf historyLeaf, metric *service.MetricRecord) []*service.SummaryItem {
+	summary := metric.GetSummary()
+	if summary.GetNone() {
+		return nil
+	}
+	// the summary is json, which has no room for non-finite numbers
+	if value, ok := leaf.value.(float64); ok && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		return nil
+	}
+
+	valueJson := leaf.valueJson
+	if valueJson == "" {
+		valueJson = jsonValue(leaf.value)
+	}
+	item := func(suffix string, valueJson string) *service.SummaryItem {
+		path := leaf.path
+		if suffix != "" {
+			path = append(path[:len(path):len(path)], suffix)
+		}
+		if len(path) == 1 {
+			return &service.SummaryItem{Key: path[0], ValueJson: valueJson}
+		}
+		return &service.SummaryItem{NestedKey: path, ValueJson: valueJson}
+	}
+
+	var items []*service.SummaryItem
+	if summary == nil || summary.Copy {
+		items = append(items, item("", valueJson))
+	}
+	value, ok := leaf.value.(float64)
+	if summary == nil || !ok {
+		return items
+	}
+
+	track := func(name string, better func(old float64) bool) bool {
+		key := metricKey(leaf.path) + "\x00" + name
+		old, ok := mh.track[key]
+		if ok && !better(old) {
+			return false
+		}
+		mh.track[key] = value
+		return true
+	}
+	if summary.Last && track("last", func(old float64) bool { return value != old }) {
+		items = append(items, item("last", valueJson))
+	}
+	maximize := metric.Goal == service.MetricRecord_GOAL_MAXIMIZE
+	if summary.Max || (summary.Best && maximize) {
+		if track("max", func(old float64) bool { return value > old }) {
+			if summary.Max {
+				items = append(items, item("max", valueJson))
+			}
+			if summary.Best && maximize {
+				items = append(items, item("best", valueJson))
+			}
+		}
+	}
+	// the best value is the min unless the goal is to maximize
+	if summary.Min || (summary.Best && !maximize) {
+		if track("min", func(old float64) bool { return value < old }) {
+			if summary.Min {
+				items = append(items, item("min", valueJson))
+			}
+			if summary.Best && !maximize {
+				items = append(items, item("best", valueJson))
+			}
+		}
+	}
+	if summary.Mean {
+		key := metricKey(leaf.path) + "\x00"
+		mh.track[key+"tot"] += value
+		mh.track[key+"num"]++
+		items = append(items, item("mean", jsonValue(mh.track[key+"tot"]/mh.track[key+"num"])))
+	}
+	return items
+}
+
+// jsonValue encodes a value as json, writing non-finite numbers like the
+// python client does
+func jsonValue(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		switch {
+		case math.IsNaN(f):
+			return "NaN"
+		case math.IsInf(f, 1):
+			return "Infinity"
+		case math.IsInf(f, -1):
+			return "-Infinity"
+		default:
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
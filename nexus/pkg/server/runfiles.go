@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/wandb/wandb/nexus/pkg/observability"
+)
+
+// maxOutputTail is how many of the last output lines are kept to be rewritten
+const maxOutputTail = 2 * maxTerminalLines
+
+// runFiles writes local copies of the files the file stream sends to the
+// files dir of the run, so they can be looked at without the server. They
+// are uploaded at the end of the run.
+type runFiles struct {
+	// dir is the files dir of the run
+	dir string
+
+	// logger is the logger for the run files
+	logger *observability.NexusLogger
+
+	// files are the open files by name
+	files map[string]*os.File
+
+	// writers are the buffered writers of the open files by name
+	writers map[string]*bufio.Writer
+
+	// failed are the files that could not be written by name
+	failed map[string]bool
+
+	// outputTail are the last lines of the output file, lines can still be
+	// rewritten while they are in it
+	outputTail []*runOutputLine
+
+	// outputWritten is how many lines of the tail are in the output file
+	outputWritten int
+
+	// outputSize is the size of the output file
+	outputSize int64
+
+	// summaryWritten is whether the summary file was written
+	summaryWritten bool
+
+	// closed is whether the files were closed at the end of the run
+	closed bool
+}
+
+// runOutputLine is a line of the output file
+type runOutputLine struct {
+	num    int
+	text   string
+	offset int64
+}
+
+func newRunFiles(dir string, logger *observability.NexusLogger) *runFiles {
+	return &runFiles{
+		dir:     dir,
+		logger:  logger,
+		files:   make(map[string]*os.File),
+		writers: make(map[string]*bufio.Writer),
+		failed:  make(map[string]bool),
+	}
+}
+
+// writer returns the writer of a file, creating the file on first use. It
+// returns nil if the file can't be written.
+func (rf *runFiles) writer(name string) *bufio.Writer {
+	if rf.dir == "" || rf.closed || rf.failed[name] {
+		return nil
+	}
+	if w, ok := rf.writers[name]; ok {
+		return w
+	}
+	if err := os.MkdirAll(rf.dir, 0755); err != nil {
+		rf.fail(name, err)
+		return nil
+	}
+	f, err := os.Create(filepath.Join(rf.dir, name))
+	if err != nil {
+		rf.fail(name, err)
+		return nil
+	}
+	rf.files[name] = f
+	rf.writers[name] = bufio.NewWriter(f)
+	return rf.writers[name]
+}
+
+// fail stops writing a file after an error
+func (rf *runFiles) fail(name string, err error) {
+	rf.logger.CaptureError(fmt.Sprintf("runfiles: error writing %s", name), err)
+	rf.failed[name] = true
+	if f, ok := rf.files[name]; ok {
+		_ = f.Close()
+		delete(rf.files, name)
+		delete(rf.writers, name)
+	}
+}
+
+// writeLine appends a line to a jsonl file
+func (rf *runFiles) writeLine(name string, line string) {
+	w := rf.writer(name)
+	if w == nil {
+		return
+	}
+	if _, err := w.WriteString(line + "\n"); err != nil {
+		rf.fail(name, err)
+	}
+}
+
+// writeSummary replaces the summary file
+func (rf *runFiles) writeSummary(summary string) {
+	if rf.dir == "" || rf.closed || rf.failed[SummaryFileName] {
+		return
+	}
+	if err := os.MkdirAll(rf.dir, 0755); err != nil {
+		rf.fail(SummaryFileName, err)
+		return
+	}
+	// write a new file and move it over the old one so that the file
+	// always has a whole summary
+	path := filepath.Join(rf.dir, SummaryFileName)
+	if err := os.WriteFile(path+".tmp", []byte(summary), 0644); err != nil {
+		rf.fail(SummaryFileName, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		rf.fail(SummaryFileName, err)
+		return
+	}
+	rf.summaryWritten = true
+}
+
+// writeOutput adds output lines to the output file. New lines are appended,
+// lines that were rewritten are replaced if they are still in the tail.
+func (rf *runFiles) writeOutput(lines []outputLine) {
+	w := rf.writer(OutputFileName)
+	if w == nil {
+		return
+	}
+
+	from := rf.outputWritten
+	for _, line := range lines {
+		idx := -1
+		for i, tailLine := range rf.outputTail {
+			if tailLine.num == line.num {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			if len(rf.outputTail) > 0 && line.num < rf.outputTail[0].num {
+				rf.logger.Debug("runfiles: output line too old to rewrite", "line", line.num)
+				continue
+			}
+			rf.outputTail = append(rf.outputTail, &runOutputLine{num: line.num, text: line.text})
+			continue
+		}
+		rf.outputTail[idx].text = line.text
+		if idx < from {
+			from = idx
+		}
+	}
+
+	// rewrite the file from the first line that changed
+	offset := rf.outputSize
+	if from < rf.outputWritten {
+		offset = rf.outputTail[from].offset
+		if err := w.Flush(); err != nil {
+			rf.fail(OutputFileName, err)
+			return
+		}
+		f := rf.files[OutputFileName]
+		if err := f.Truncate(offset); err != nil {
+			rf.fail(OutputFileName, err)
+			return
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			rf.fail(OutputFileName, err)
+			return
+		}
+	}
+	for _, line := range rf.outputTail[from:] {
+		line.offset = offset
+		if _, err := w.WriteString(line.text + "\n"); err != nil {
+			rf.fail(OutputFileName, err)
+			return
+		}
+		offset += int64(len(line.text)) + 1
+	}
+	rf.outputSize = offset
+	rf.outputWritten = len(rf.outputTail)
+
+	if drop := len(rf.outputTail) - maxOutputTail; drop > 0 {
+		rf.outputTail = rf.outputTail[drop:]
+		rf.outputWritten -= drop
+	}
+}
+
+// close flushes and closes the files, returning the names of the files that
+// were written
+func (rf *runFiles) close() []string {
+	if rf.closed {
+		return nil
+	}
+	rf.closed = true
+
+	var names []string
+	for _, name := range []string{OutputFileName, HistoryFileName, EventsFileName} {
+		f, ok := rf.files[name]
+		if !ok {
+			continue
+		}
+		err := rf.writers[name].Flush()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			rf.logger.CaptureError(fmt.Sprintf("runfiles: error closing %s", name), err)
+			continue
+		}
+		names = append(names, name)
+	}
+	if rf.summaryWritten && !rf.failed[SummaryFileName] {
+		names = append(names, SummaryFileName)
+	}
+	return names
+}
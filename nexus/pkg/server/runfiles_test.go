@@ -0,0 +1,39 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+)
+
+func TestRunFiles(t *testing.T) {
+	dir := t.TempDir()
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	rf := newRunFiles(dir, logger)
+
+	rf.writeOutput([]outputLine{{num: 0, text: "a"}, {num: 1, text: "b"}, {num: 2, text: "c"}})
+	// rewriting a line rewrites the lines after it
+	rf.writeOutput([]outputLine{{num: 1, text: "progress"}, {num: 3, text: "d"}})
+	rf.writeOutput([]outputLine{{num: 3, text: "e"}})
+	rf.writeLine(HistoryFileName, `{"_step":0}`)
+	rf.writeSummary(`{"loss":1}`)
+	rf.writeSummary(`{"loss":0.5}`)
+
+	assert.ElementsMatch(t, []string{OutputFileName, HistoryFileName, SummaryFileName}, rf.close())
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		return string(data)
+	}
+	assert.Equal(t, "a\nprogress\nc\ne\n", read(OutputFileName))
+	assert.Equal(t, "{\"_step\":0}\n", read(HistoryFileName))
+	assert.Equal(t, `{"loss":0.5}`, read(SummaryFileName))
+
+	// nothing is written after the files are closed
+	rf.writeLine(HistoryFileName, `{"_step":1}`)
+	assert.Equal(t, "{\"_step\":0}\n", read(HistoryFileName))
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// historySampleSize is the number of values kept per history key
+const historySampleSize = 64
+
+// sampledValue is a history value kept in a sample
+type sampledValue struct {
+	// index is the position of the value in the history of its key
+	index int64
+
+	// value is the value, or the integer value if isInt
+	value float64
+	ival  int64
+	isInt bool
+}
+
+// historySample is a uniform sample of the values of a history key, kept
+// with reservoir sampling so that its size is fixed however long the run is
+type historySample struct {
+	// values are the sampled values
+	values []sampledValue
+
+	// count is the number of values seen
+	count int64
+}
+
+// add adds a history value to the sample, values that are not numbers
+// are ignored
+func (hs *historySample) add(valueJson string) {
+	var value sampledValue
+	if i, err := strconv.ParseInt(valueJson, 10, 64); err == nil {
+		value = sampledValue{value: float64(i), ival: i, isInt: true}
+	} else if f, err := strconv.ParseFloat(valueJson, 64); err == nil {
+		value = sampledValue{value: f}
+	} else {
+		return
+	}
+	value.index = hs.count
+	hs.count++
+
+	if len(hs.values) < historySampleSize {
+		hs.values = append(hs.values, value)
+		return
+	}
+	if j := rand.Int63n(hs.count); j < historySampleSize {
+		hs.values[j] = value
+	}
+}
+
+// get returns the sampled values in history order, as integers if all of
+// them are integers
+func (hs *historySample) get() ([]float32, []int64) {
+	values := make([]sampledValue, len(hs.values))
+	copy(values, hs.values)
+	sort.Slice(values, func(i, j int) bool { return values[i].index < values[j].index })
+
+	allInt := true
+	for _, value := range values {
+		allInt = allInt && value.isInt
+	}
+	if allInt {
+		ints := make([]int64, len(values))
+		for i, value := range values {
+			ints[i] = value.ival
+		}
+		return nil, ints
+	}
+	floats := make([]float32, len(values))
+	for i, value := range values {
+		floats[i] = float32(value.value)
+	}
+	return floats, nil
+}
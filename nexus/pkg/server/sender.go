@@ -3,10 +3,13 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/wandb/wandb/nexus/internal/gql"
 	"github.com/wandb/wandb/nexus/internal/nexuslib"
@@ -23,6 +26,9 @@ import (
 const (
 	MetaFilename = "wandb-metadata.json"
 	NexusVersion = "0.0.1a2"
+
+	// summaryInterval is how often the summary is streamed when it changed
+	summaryInterval = 2 * time.Second
 )
 
 type ResumeState struct {
@@ -66,11 +72,41 @@ type Sender struct {
 	telemetry *service.TelemetryRecord
 
 	// Keep track of summary which is being updated incrementally
-	summaryMap map[string]*service.SummaryItem
+	summaryMap StateStore
+
+	// summaryChanged is whether the summary changed since it was streamed
+	summaryChanged bool
+
+	// outputBuffer turns the console output into lines
+	outputBuffer *outputBuffer
+
+	// runFiles are the local copies of the files sent by the file stream
+	runFiles *runFiles
+
+	// endFiles are the files to upload at the end of the run
+	endFiles []string
+
+	// liveFiles are the files uploaded again when they change
+	liveFiles *liveFiles
+
+	// stopPoller asks the server whether the run was stopped from the UI
+	stopPoller *stopPoller
+
+	// status is the progress of the run, the handler answers from it
+	status *runStatus
 
 	// Keep track of config which is being updated incrementally
 	configMap map[string]interface{}
 
+	// metricDefs are the merged metric definitions by name
+	metricDefs map[string]*service.MetricRecord
+
+	// configMetrics are the metrics encoded for the config, in definition order
+	configMetrics []map[int]interface{}
+
+	// configMetricIndex is the index of each metric in configMetrics
+	configMetricIndex map[string]int
+
 	// Keep track of exit record to pass to file stream when the time comes
 	exitRecord *service.Record
 }
@@ -89,20 +125,27 @@ func emptyAsNil(s *string) *string {
 func NewSender(ctx context.Context, settings *service.Settings, logger *observability.NexusLogger) *Sender {
 
 	sender := &Sender{
-		ctx:        ctx,
-		settings:   settings,
-		logger:     logger,
-		summaryMap: make(map[string]*service.SummaryItem),
-		configMap:  make(map[string]interface{}),
-		recordChan: make(chan *service.Record, BufferSize),
-		resultChan: make(chan *service.Result, BufferSize),
-		telemetry:  &service.TelemetryRecord{CoreVersion: NexusVersion},
+		ctx:          ctx,
+		settings:     settings,
+		logger:       logger,
+		summaryMap:   NewStateStore(settings, "sender-summary", logger),
+		outputBuffer: newOutputBuffer(),
+		runFiles:     newRunFiles(settings.GetFilesDir().GetValue(), logger),
+		configMap:    make(map[string]interface{}),
+		recordChan:   make(chan *service.Record, BufferSize),
+		resultChan:   make(chan *service.Result, BufferSize),
+		telemetry:    &service.TelemetryRecord{CoreVersion: NexusVersion},
+
+		status:            newRunStatus(),
+		metricDefs:        make(map[string]*service.MetricRecord),
+		configMetricIndex: make(map[string]int),
 	}
 	if !settings.GetXOffline().GetValue() {
 		url := fmt.Sprintf("%s/graphql", settings.GetBaseUrl().GetValue())
 		apiKey := settings.GetApiKey().GetValue()
-		sender.graphqlClient = newGraphqlClient(url, apiKey, logger)
+		sender.graphqlClient = newGraphqlClient(url, apiKey, logger, sender.status.networkStatus)
 	}
+	sender.liveFiles = newLiveFiles(settings.GetFilesDir().GetValue(), logger)
 	return sender
 }
 
@@ -110,8 +153,29 @@ func NewSender(ctx context.Context, settings *service.Settings, logger *observab
 func (s *Sender) do(inChan <-chan *service.Record) {
 	s.logger.Info("sender: started", "stream_id", s.settings.RunId)
 
-	for record := range inChan {
-		s.sendRecord(record)
+	// live files are uploaded again from this loop, so that only the
+	// sender uses the run and the uploader
+	summaryTicker := time.NewTicker(summaryInterval)
+	defer summaryTicker.Stop()
+loop:
+	for {
+		select {
+		case record, ok := <-inChan:
+			if !ok {
+				break loop
+			}
+			s.sendRecord(record)
+		case name := <-s.liveFiles.changed:
+			s.sendFile(name)
+		case <-summaryTicker.C:
+			s.streamSummary()
+		}
+	}
+	s.summaryMap.Close()
+	s.runFiles.close()
+	s.liveFiles.stop()
+	if s.stopPoller != nil {
+		s.stopPoller.stop()
 	}
 	s.logger.Info("sender: closed", "stream_id", s.settings.RunId)
 }
@@ -140,6 +204,10 @@ func (s *Sender) sendRecord(record *service.Record) {
 		s.sendOutputRaw(record, x.OutputRaw)
 	case *service.Record_Telemetry:
 		s.sendTelemetry(record, x.Telemetry)
+	case *service.Record_Metric:
+		s.sendMetric(record, x.Metric)
+	case *service.Record_Tbrecord:
+		// the handler follows the event files and sends their history and files
 	case *service.Record_Request:
 		s.sendRequest(record, x.Request)
 	case nil:
@@ -157,8 +225,6 @@ func (s *Sender) sendRequest(record *service.Record, request *service.Request) {
 	switch x := request.RequestType.(type) {
 	case *service.Request_RunStart:
 		s.sendRunStart(x.RunStart)
-	case *service.Request_NetworkStatus:
-		s.sendNetworkStatusRequest(x.NetworkStatus)
 	case *service.Request_Defer:
 		s.sendDefer(x.Defer)
 	case *service.Request_Metadata:
@@ -182,15 +248,24 @@ func (s *Sender) sendRunStart(_ *service.RunStartRequest) {
 			}
 		}
 		s.fileStream.Start()
-		s.uploader = uploader.NewUploader(s.ctx, s.logger)
+		options, err := uploader.OptionsFromEnv()
+		if err != nil {
+			s.logger.CaptureError("sender: invalid uploader options", err)
+		}
+		s.uploader = uploader.NewUploader(s.ctx, s.logger, options)
 		s.uploader.Start()
+		interval, err := StopPollingIntervalFromEnv()
+		if err != nil {
+			s.logger.CaptureError("sender: invalid stop polling interval", err)
+		}
+		s.stopPoller = newStopPoller(s.ctx, s.logger, s.graphqlClient,
+			s.RunRecord.Entity, s.RunRecord.Project, s.RunRecord.RunId, interval)
+		s.stopPoller.start()
+		s.status.start(s.uploader, s.fileStream, s.stopPoller)
 	}
 
 }
 
-func (s *Sender) sendNetworkStatusRequest(_ *service.NetworkStatusRequest) {
-}
-
 func (s *Sender) sendMetadata(request *service.MetadataRequest) {
 	mo := protojson.MarshalOptions{
 		Indent: "  ",
@@ -207,6 +282,10 @@ func (s *Sender) sendDefer(request *service.DeferRequest) {
 		request.State++
 		s.sendRequestDefer(request)
 	case service.DeferRequest_FLUSH_RUN:
+		// the run is exiting, it no longer needs to know if it was stopped
+		if s.stopPoller != nil {
+			s.stopPoller.stop()
+		}
 		request.State++
 		s.sendRequestDefer(request)
 	case service.DeferRequest_FLUSH_STATS:
@@ -219,40 +298,60 @@ func (s *Sender) sendDefer(request *service.DeferRequest) {
 		request.State++
 		s.sendRequestDefer(request)
 	case service.DeferRequest_FLUSH_SUM:
+		s.streamSummary()
 		request.State++
 		s.sendRequestDefer(request)
 	case service.DeferRequest_FLUSH_DEBOUNCER:
 		request.State++
 		s.sendRequestDefer(request)
 	case service.DeferRequest_FLUSH_OUTPUT:
+		s.sendOutputLines(s.outputBuffer.flush())
 		request.State++
 		s.sendRequestDefer(request)
 	case service.DeferRequest_FLUSH_JOB:
 		request.State++
 		s.sendRequestDefer(request)
 	case service.DeferRequest_FLUSH_DIR:
+		s.sendEndFiles()
 		request.State++
 		s.sendRequestDefer(request)
 	case service.DeferRequest_FLUSH_FP:
-		if s.uploader != nil {
-			s.uploader.Close()
-		}
+		// nothing more is uploaded once the uploader is closing, the files
+		// still coming are reported as failed
+		fileUploader := s.uploader
+		s.uploader = nil
 		request.State++
-		s.sendRequestDefer(request)
+		s.sendRequestDeferAfter(request, func() {
+			if fileUploader != nil {
+				fileUploader.Close()
+			}
+		})
 	case service.DeferRequest_JOIN_FP:
 		request.State++
 		s.sendRequestDefer(request)
 	case service.DeferRequest_FLUSH_FS:
-		if s.fileStream != nil {
-			s.fileStream.Close()
-		}
 		request.State++
-		s.sendRequestDefer(request)
+		// nothing more is streamed once the file stream is closing, the
+		// records still coming are only written to the run files
+		fileStream := s.fileStream
+		s.fileStream = nil
+		s.sendRequestDeferAfter(request, func() {
+			if fileStream != nil {
+				fileStream.Close()
+			}
+			s.status.finish()
+		})
 	case service.DeferRequest_FLUSH_FINAL:
 		request.State++
 		s.sendRequestDefer(request)
 	case service.DeferRequest_END:
 		request.State++
+		// the client no longer asks for the network status once the run
+		// exited, and the exit response has no room for the failures
+		if failed := s.status.failed(); len(failed) > 0 {
+			err := fmt.Errorf("failed to upload %s", strings.Join(failed, ", "))
+			s.logger.CaptureError("sender: some files were not uploaded", err)
+		}
 		if s.exitRecord != nil {
 			s.respondExit(s.exitRecord)
 		}
@@ -274,6 +373,16 @@ func (s *Sender) sendRequestDefer(request *service.DeferRequest) {
 	s.recordChan <- rec
 }
 
+// sendRequestDeferAfter moves the defer state machine on once flush returns.
+// Flushing can take a while, it is done without blocking the sender so that
+// the sender keeps handling records meanwhile.
+func (s *Sender) sendRequestDeferAfter(request *service.DeferRequest, flush func()) {
+	go func() {
+		flush()
+		s.sendRequestDefer(request)
+	}()
+}
+
 func (s *Sender) sendTelemetry(record *service.Record, telemetry *service.TelemetryRecord) {
 	proto.Merge(s.telemetry, telemetry)
 	s.updateConfigPrivate(s.telemetry)
@@ -415,19 +524,50 @@ func (s *Sender) checkAndUpdateResumeState(run *service.RunRecord) error {
 }
 
 // updateConfig updates the config map with the config record
+// nested keys are merged into the config tree like the python client does,
+// the maps along the path are created or kept and the value at the path
+// is replaced
 func (s *Sender) updateConfig(configRecord *service.ConfigRecord) {
-	// TODO: handle nested key updates and deletes
 	for _, d := range configRecord.GetUpdate() {
 		var value interface{}
 		if err := json.Unmarshal([]byte(d.GetValueJson()), &value); err != nil {
 			s.logger.CaptureError("unmarshal problem", err)
 			continue
 		}
-		s.configMap[d.GetKey()] = value
+		nexuslib.SetNested(s.configMap, nexuslib.KeyPath(d.GetKey(), d.GetNestedKey()), value)
 	}
 	for _, d := range configRecord.GetRemove() {
-		delete(s.configMap, d.GetKey())
+		nexuslib.DeleteNested(s.configMap, nexuslib.KeyPath(d.GetKey(), d.GetNestedKey()))
+	}
+}
+
+// sendMetric adds a metric definition to the config, where the UI reads it from.
+// Step metrics are referenced by their (1-based) index in the metrics list.
+func (s *Sender) sendMetric(_ *service.Record, metric *service.MetricRecord) {
+	// the handler defines the metrics matching globs by name
+	if metric.GlobName != "" {
+		return
+	}
+	metric = mergeMetric(s.metricDefs[metric.Name], metric)
+	s.metricDefs[metric.Name] = metric
+
+	if metric.StepMetric != "" {
+		if index, ok := s.configMetricIndex[metric.StepMetric]; ok {
+			metric = proto.Clone(metric).(*service.MetricRecord)
+			metric.StepMetric = ""
+			metric.StepMetricIndex = int32(index + 1)
+		}
 	}
+	encoded := nexuslib.ProtoEncodeToDict(metric)
+	if index, ok := s.configMetricIndex[metric.Name]; ok {
+		s.configMetrics[index] = encoded
+	} else {
+		s.configMetricIndex[metric.Name] = len(s.configMetrics)
+		s.configMetrics = append(s.configMetrics, encoded)
+	}
+	nexuslib.SetNested(s.configMap, []string{"_wandb", "m"}, s.configMetrics)
+	// TODO(perf): improve when debounce config is added, for now this sends all the time
+	s.sendConfig(nil, nil)
 }
 
 // updateConfigPrivate updates the private part of the config map
@@ -582,41 +722,70 @@ func (s *Sender) sendRun(record *service.Record, run *service.RunRecord) {
 
 // sendHistory sends a history record to the file stream,
 // which will then send it to the server
-func (s *Sender) sendHistory(record *service.Record, _ *service.HistoryRecord) {
+func (s *Sender) sendHistory(record *service.Record, history *service.HistoryRecord) {
+	if line, err := nexuslib.JsonifyItems(history.Item); err != nil {
+		s.logger.CaptureError("sender: sendHistory: failed to jsonify history", err)
+	} else {
+		s.runFiles.writeLine(HistoryFileName, line)
+	}
+
 	if s.fileStream != nil {
 		s.fileStream.StreamRecord(record)
 	}
 }
 
+// sendSummary updates the summary, which is streamed every summaryInterval
+// rather than on every update as each one sends the whole summary
 func (s *Sender) sendSummary(_ *service.Record, summary *service.SummaryRecord) {
-	// TODO(network): buffer summary sending for network efficiency until we can send only updates
-	// TODO(compat): handle deletes, nested keys
-	// TODO(compat): write summary file
-
-	// track each key in the in memory summary store
-	// TODO(memory): avoid keeping summary for all distinct keys
+	// track each key in the summary store, the handler has already
+	// resolved nested keys to their top level key
 	for _, item := range summary.Update {
-		s.summaryMap[item.Key] = item
+		s.summaryMap.Set(item.Key, item.ValueJson)
 	}
-
-	// build list of summary items from the map
-	var summaryItems []*service.SummaryItem
-	for _, v := range s.summaryMap {
-		summaryItems = append(summaryItems, v)
+	for _, item := range summary.Remove {
+		s.summaryMap.Delete(item.Key)
 	}
+	s.summaryChanged = true
+}
 
-	// build a full summary record to send
-	record := &service.Record{
-		RecordType: &service.Record_Summary{
-			Summary: &service.SummaryRecord{
-				Update: summaryItems,
-			},
-		},
+// streamSummary streams the summary if it changed since it was last streamed
+func (s *Sender) streamSummary() {
+	if !s.summaryChanged || s.fileStream == nil {
+		return
 	}
+	s.summaryChanged = false
+	// the line is written straight from the store, so no copy of the items
+	// is built
+	s.fileStream.StreamSummary(summaryLine(s.summaryMap, s.logger))
+}
 
-	if s.fileStream != nil {
-		s.fileStream.StreamRecord(record)
-	}
+// summaryLine returns the json object of all the keys in a summary store,
+// the values are already json so they are written as they are
+func summaryLine(store StateStore, logger *observability.NexusLogger) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	store.Range(func(key string, value string) bool {
+		// json.Valid doesn't check that the strings are utf-8
+		if !json.Valid([]byte(value)) || !utf8.ValidString(value) {
+			logger.CaptureError("sender: summaryLine: invalid summary value",
+				fmt.Errorf("key %q: %q", key, value))
+			return true
+		}
+		jsonKey, err := json.Marshal(key)
+		if err != nil {
+			logger.CaptureError("sender: summaryLine: failed to marshal summary key", err)
+			return true
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.Write(jsonKey)
+		b.WriteByte(':')
+		b.WriteString(value)
+		return true
+	})
+	b.WriteByte('}')
+	return b.String()
 }
 
 // sendConfig sends a config record to the server via an upsertBucket mutation
@@ -661,34 +830,32 @@ func (s *Sender) sendConfig(_ *service.Record, configRecord *service.ConfigRecor
 }
 
 // sendSystemMetrics sends a system metrics record via the file stream
-func (s *Sender) sendSystemMetrics(record *service.Record, _ *service.StatsRecord) {
+func (s *Sender) sendSystemMetrics(record *service.Record, stats *service.StatsRecord) {
+	if line, err := systemMetricsLine(stats, s.settings.GetXStartTime().GetValue(), s.logger); err != nil {
+		s.logger.CaptureError("sender: sendSystemMetrics: failed to marshal system metrics", err)
+	} else {
+		s.runFiles.writeLine(EventsFileName, line)
+	}
+
 	if s.fileStream != nil {
 		s.fileStream.StreamRecord(record)
 	}
 }
 
-func (s *Sender) sendOutputRaw(record *service.Record, _ *service.OutputRawRecord) {
-	// TODO: match logic handling of lines to the one in the python version
-	// - handle carriage returns (for tqdm-like progress bars)
-	// - handle caching multiple (non-new lines) and sending them in one chunk
-	// - handle lines longer than ~60_000 characters
-
-	// copy the record to avoid mutating the original
-	recordCopy := proto.Clone(record).(*service.Record)
-	outputRaw := recordCopy.GetOutputRaw()
+// sendOutputRaw streams the console output lines finished by the raw output,
+// the unfinished line is kept until it ends or the output is flushed
+func (s *Sender) sendOutputRaw(_ *service.Record, outputRaw *service.OutputRawRecord) {
+	s.sendOutputLines(s.outputBuffer.write(outputRaw, time.Now()))
+}
 
-	// ignore empty "new lines"
-	if outputRaw.Line == "\n" {
+// sendOutputLines writes console output lines to the output file and streams them
+func (s *Sender) sendOutputLines(lines []outputLine) {
+	if len(lines) == 0 {
 		return
 	}
-	t := time.Now().UTC().Format(time.RFC3339)
-	outputRaw.Line = fmt.Sprintf("%s %s", t, outputRaw.Line)
-	if outputRaw.OutputType == service.OutputRawRecord_STDERR {
-		outputRaw.Line = fmt.Sprintf("ERROR %s", outputRaw.Line)
-	}
-
+	s.runFiles.writeOutput(lines)
 	if s.fileStream != nil {
-		s.fileStream.StreamRecord(recordCopy)
+		s.fileStream.StreamOutputLines(lines)
 	}
 }
 
@@ -759,38 +926,115 @@ func (s *Sender) sendExit(record *service.Record, _ *service.RunExitRecord) {
 	s.recordChan <- rec
 }
 
-// sendFiles iterates over the files in the FilesRecord and sends them to
+// sendFiles uploads the files in the FilesRecord according to their policy:
+// now files are uploaded once, end files at the end of the run and live files
+// now and again every time they change
 func (s *Sender) sendFiles(_ *service.Record, filesRecord *service.FilesRecord) {
-	files := filesRecord.GetFiles()
-	for _, file := range files {
-		s.sendFile(file.GetPath())
+	for _, file := range filesRecord.GetFiles() {
+		switch file.GetPolicy() {
+		case service.FilesItem_END:
+			s.endFiles = append(s.endFiles, file.GetPath())
+		case service.FilesItem_LIVE:
+			s.sendFile(file.GetPath())
+			s.liveFiles.add(file.GetPath())
+		default:
+			s.sendFile(file.GetPath())
+		}
+	}
+}
+
+// sendEndFiles uploads the files of the run that are uploaded at its end:
+// the local copies of the streamed files, the end files and the final
+// versions of the live files
+func (s *Sender) sendEndFiles() {
+	// the summary file is only written once, with the final summary
+	s.runFiles.writeSummary(summaryLine(s.summaryMap, s.logger))
+
+	// the run files may be written somewhere else than the files dir
+	sent := make(map[string]bool)
+	for _, name := range s.runFiles.close() {
+		sent[name] = true
+		s.uploadFile(s.runFiles.dir, name)
+	}
+
+	names := append(append([]string(nil), s.endFiles...), s.liveFiles.stop()...)
+	for _, name := range names {
+		if sent[name] {
+			continue
+		}
+		sent[name] = true
+		s.sendFile(name)
 	}
 }
 
-// sendFile sends a file to the server
+// sendFile sends a file in the files dir to the server
 func (s *Sender) sendFile(name string) {
-	if s.graphqlClient == nil || s.uploader == nil {
+	s.uploadFile(s.settings.GetFilesDir().GetValue(), name)
+}
+
+// uploadFile uploads the file with the name in dir to the run files. A file
+// that can't be uploaded is reported like a failed upload.
+func (s *Sender) uploadFile(dir string, name string) {
+	if s.graphqlClient == nil {
+		return
+	}
+
+	if s.uploader == nil {
+		s.logger.CaptureError("sender: uploadFile: uploader closed", fmt.Errorf("file %s", name))
+		s.uploadComplete(name, &uploader.UploadResult{Path: name, Err: errors.New("uploads are closed")})
 		return
 	}
 
 	if s.RunRecord == nil {
-		err := fmt.Errorf("sender: sendFile: RunRecord not set")
-		s.logger.CaptureFatalAndPanic("sender received error", err)
+		s.logger.CaptureError("sender: uploadFile: RunRecord not set", fmt.Errorf("file %s", name))
+		s.uploadComplete(name, &uploader.UploadResult{Path: name, Err: errors.New("run not started")})
+		return
 	}
 
 	data, err := gql.CreateRunFiles(s.ctx, s.graphqlClient, s.RunRecord.Entity, s.RunRecord.Project, s.RunRecord.RunId, []string{name})
 	if err != nil {
-		err = fmt.Errorf("sender: sendFile: failed to get upload urls: %s", err)
-		s.logger.CaptureFatalAndPanic("sender received error", err)
+		err = fmt.Errorf("sender: uploadFile: failed to get upload urls: %s", err)
+		s.logger.CaptureError("sender received error", err)
+		s.uploadComplete(name, &uploader.UploadResult{Path: name, Err: err})
+		return
 	}
 
 	for _, file := range data.GetCreateRunFiles().GetFiles() {
-		fullPath := filepath.Join(s.settings.GetFilesDir().GetValue(), file.Name)
-		task := &uploader.UploadTask{Path: fullPath, Url: *file.UploadUrl}
+		fileName := file.Name
+		task := &uploader.UploadTask{
+			Path:     filepath.Join(dir, fileName),
+			Url:      *file.UploadUrl,
+			FileKind: fileKind(fileName),
+			OnComplete: func(result *uploader.UploadResult) {
+				s.uploadComplete(fileName, result)
+			},
+		}
 		s.uploader.AddTask(task)
 	}
 }
 
+// uploadComplete keeps the failed uploads to report them to the user, by
+// the name of the file in the run
+func (s *Sender) uploadComplete(name string, result *uploader.UploadResult) {
+	if result.Err == nil {
+		return
+	}
+	s.status.uploadFailed(name, result)
+}
+
+// fileKind returns the kind a run file is counted as
+func fileKind(name string) uploader.FileKind {
+	switch {
+	case strings.HasPrefix(name, "media/"):
+		return uploader.MediaFile
+	case strings.HasPrefix(name, "wandb"), name == OutputFileName,
+		name == "config.yaml", name == "requirements.txt", name == "diff.patch":
+		return uploader.WandbFile
+	default:
+		return uploader.OtherFile
+	}
+}
+
 func (s *Sender) sendLogArtifact(record *service.Record, msg *service.LogArtifactRequest) {
 	saver := artifacts.ArtifactSaver{
 		Ctx:           s.ctx,
@@ -799,18 +1043,22 @@ func (s *Sender) sendLogArtifact(record *service.Record, msg *service.LogArtifac
 		GraphqlClient: s.graphqlClient,
 		Uploader:      s.uploader,
 	}
-	saverResult, err := saver.Save()
-	if err != nil {
-		s.logger.CaptureFatalAndPanic("sender: sendLogArtifact: save failure", err)
+	response := &service.LogArtifactResponse{}
+	if s.uploader == nil {
+		response.ErrorMessage = "sender: sendLogArtifact: uploads are closed"
+		s.logger.CaptureError("sender: sendLogArtifact: save failure", errors.New(response.ErrorMessage))
+	} else if saverResult, err := saver.Save(); err != nil {
+		s.logger.CaptureError("sender: sendLogArtifact: save failure", err)
+		response.ErrorMessage = err.Error()
+	} else {
+		response.ArtifactId = saverResult.ArtifactId
 	}
 
 	result := &service.Result{
 		ResultType: &service.Result_Response{
 			Response: &service.Response{
 				ResponseType: &service.Response_LogArtifactResponse{
-					LogArtifactResponse: &service.LogArtifactResponse{
-						ArtifactId: saverResult.ArtifactId,
-					},
+					LogArtifactResponse: response,
 				},
 			},
 		},
@@ -1,21 +1,29 @@
 package server
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Khan/genqlient/graphql"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/wandb/wandb/nexus/internal/gql"
 	"github.com/wandb/wandb/nexus/internal/nexustest"
+	"github.com/wandb/wandb/nexus/internal/uploader"
 	"github.com/wandb/wandb/nexus/pkg/observability"
 	"github.com/wandb/wandb/nexus/pkg/service"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
-func makeSender(client graphql.Client, resultChan chan *service.Result) Sender {
+func makeSender(client graphql.Client, resultChan chan *service.Result) *Sender {
 	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
-	sender := Sender{
+	sender := &Sender{
 		logger: logger,
 		settings: &service.Settings{
 			RunId: &wrapperspb.StringValue{Value: "run1"},
@@ -23,6 +31,13 @@ func makeSender(client graphql.Client, resultChan chan *service.Result) Sender {
 		graphqlClient: client,
 		resultChan:    resultChan,
 		configMap:     make(map[string]interface{}),
+		outputBuffer:  newOutputBuffer(),
+		runFiles:      newRunFiles("", logger),
+		liveFiles:     newLiveFiles("", logger),
+		status:        newRunStatus(),
+
+		metricDefs:        make(map[string]*service.MetricRecord),
+		configMetricIndex: make(map[string]int),
 	}
 	return sender
 }
@@ -75,3 +90,203 @@ func TestSendRun(t *testing.T) {
 	sender.sendRecord(run)
 	<-sender.resultChan
 }
+
+func TestUpdateConfigNested(t *testing.T) {
+	sender := makeSender(nil, nil)
+	sender.configMap["lr"] = 0.1
+	sender.configMap["model"] = map[string]interface{}{"layers": 2.0, "act": "relu"}
+
+	sender.updateConfig(&service.ConfigRecord{
+		Update: []*service.ConfigItem{
+			{NestedKey: []string{"model", "layers"}, ValueJson: "4"},
+			{NestedKey: []string{"model", "opt", "name"}, ValueJson: `"adam"`},
+			{NestedKey: []string{"lr", "schedule"}, ValueJson: `"cosine"`},
+		},
+		Remove: []*service.ConfigItem{
+			{NestedKey: []string{"model", "act"}},
+			{Key: "missing"},
+		},
+	})
+
+	assert.JSONEq(t,
+		`{
+			"lr": {"value": {"schedule": "cosine"}},
+			"model": {"value": {"layers": 4, "opt": {"name": "adam"}}}
+		}`,
+		sender.serializeConfig(),
+	)
+}
+
+func TestSendMetric(t *testing.T) {
+	sender := makeSender(nil, nil)
+	sender.sendMetric(nil, &service.MetricRecord{Name: "epoch"})
+	sender.sendMetric(nil, &service.MetricRecord{Name: "loss", StepMetric: "epoch"})
+	sender.sendMetric(nil, &service.MetricRecord{Name: "loss", Summary: &service.MetricSummary{Min: true}})
+	sender.sendMetric(nil, &service.MetricRecord{GlobName: "val/*"})
+
+	assert.JSONEq(t,
+		`{"_wandb": {"value": {"m": [
+			{"1": "epoch"},
+			{"1": "loss", "5": 1, "7": [1]}
+		]}}}`,
+		sender.serializeConfig(),
+	)
+}
+
+func TestStopStatus(t *testing.T) {
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	fileStream := NewFileStream("", &service.Settings{}, logger)
+	status := newRunStatus()
+	status.start(nil, fileStream, nil)
+
+	rateLimit := 3.0
+	fileStream.handleReply(&FsReply{Limits: &FsLimits{RateLimitSeconds: &rateLimit}})
+	assert.Equal(t, 3*time.Second, fileStream.heartbeat())
+	assert.False(t, status.stopStatus().GetRunShouldStop())
+
+	// an exit code before the run exited means it was stopped from the UI
+	exitCode := int32(0)
+	fileStream.handleReply(&FsReply{Exitcode: &exitCode})
+	assert.True(t, status.stopStatus().GetRunShouldStop())
+}
+
+func TestStopPoller(t *testing.T) {
+	to := nexustest.MakeTestObject(t)
+	defer to.TeardownTest()
+
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	stopPoller := newStopPoller(context.Background(), logger, to.MockClient,
+		"testEntity", "testProject", "run1", time.Hour)
+	status := newRunStatus()
+	status.start(nil, nil, stopPoller)
+
+	stopped := true
+	respEncode := &graphql.Response{
+		Data: &gql.RunStoppedStatusResponse{
+			Project: &gql.RunStoppedStatusProject{
+				Run: &gql.RunStoppedStatusProjectRun{Stopped: &stopped},
+			},
+		}}
+	to.MockClient.EXPECT().MakeRequest(
+		gomock.Any(), // context.Context
+		gomock.Any(), // *graphql.Request
+		gomock.Any(), // *graphql.Response
+	).Return(nil).Do(nexustest.InjectResponse(
+		respEncode,
+		func(vars nexustest.RequestVars) {
+			assert.Equal(t, "testEntity", vars["entityName"])
+			assert.Equal(t, "testProject", vars["projectName"])
+			assert.Equal(t, "run1", vars["runId"])
+		},
+	))
+
+	assert.False(t, status.stopStatus().GetRunShouldStop())
+
+	stopPoller.poll()
+	assert.True(t, status.stopStatus().GetRunShouldStop())
+
+	stopPoller.start()
+	stopPoller.stop()
+	stopPoller.stop()
+}
+
+func TestSummaryLine(t *testing.T) {
+	store := NewMemoryStateStore()
+	store.Set("b", `{"c":1}`)
+	store.Set("a", `"x"`)
+	store.Set("bad", `{`)
+	assert.Equal(t, `{"a":"x","b":{"c":1}}`, summaryLine(store, observability.NewNexusLogger(SetupDefaultLogger(), nil)))
+}
+
+func TestSendSummaryDebounced(t *testing.T) {
+	sender := makeSender(nil, make(chan *service.Result, 1))
+	sender.summaryMap = NewMemoryStateStore()
+	sender.runFiles = newRunFiles(t.TempDir(), sender.logger)
+	sender.fileStream = NewFileStream("", sender.settings, sender.logger)
+
+	for _, value := range []string{"1", "2"} {
+		sender.sendRecord(&service.Record{RecordType: &service.Record_Summary{
+			Summary: &service.SummaryRecord{Update: []*service.SummaryItem{{Key: "a", ValueJson: value}}}}})
+	}
+	// updates are streamed together, and only when the summary changed
+	assert.Empty(t, sender.fileStream.chunkChan)
+	sender.streamSummary()
+	sender.streamSummary()
+	assert.Len(t, sender.fileStream.chunkChan, 1)
+	assert.Equal(t, `{"a":2}`, (<-sender.fileStream.chunkChan).fileData.line)
+
+	// the summary file is written at the end of the run
+	_, err := os.Stat(filepath.Join(sender.runFiles.dir, SummaryFileName))
+	assert.True(t, os.IsNotExist(err))
+	sender.sendEndFiles()
+	data, err := os.ReadFile(filepath.Join(sender.runFiles.dir, SummaryFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":2}`, string(data))
+}
+
+func TestSendOutputRaw(t *testing.T) {
+	sender := makeSender(nil, make(chan *service.Result, 1))
+	sender.runFiles = newRunFiles(t.TempDir(), sender.logger)
+	sender.fileStream = NewFileStream("", sender.settings, sender.logger)
+
+	sender.sendRecord(&service.Record{RecordType: &service.Record_OutputRaw{
+		OutputRaw: &service.OutputRawRecord{OutputType: service.OutputRawRecord_STDERR, Line: "oops\n"}}})
+	// the time and the error mark are only streamed
+	line := (<-sender.fileStream.chunkChan).fileData.line
+	assert.True(t, strings.HasPrefix(line, "ERROR "))
+	assert.True(t, strings.HasSuffix(line, "Z oops"))
+	sender.runFiles.close()
+	data, err := os.ReadFile(filepath.Join(sender.runFiles.dir, OutputFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, "oops\n", string(data))
+}
+
+func TestUploadFileWithoutRun(t *testing.T) {
+	sender := makeSender(nil, make(chan *service.Result, 1))
+	sender.graphqlClient = graphql.NewClient("http://localhost", nil)
+	sender.uploader = uploader.NewUploader(context.Background(), sender.logger, uploader.Options{})
+
+	// a file that can't be uploaded is reported, the run goes on
+	sender.sendFile("config.yaml")
+	assert.Equal(t, []string{"config.yaml"}, sender.status.failed())
+}
+
+func TestSendAfterFlushFS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	sender := makeSender(nil, make(chan *service.Result, 1))
+	sender.recordChan = make(chan *service.Record, 1)
+	sender.summaryMap = NewMemoryStateStore()
+	sender.fileStream = NewFileStream(server.URL, sender.settings, sender.logger)
+	sender.fileStream.Start()
+
+	sender.sendDefer(&service.DeferRequest{State: service.DeferRequest_FLUSH_FS})
+	// records still coming while the file stream closes are not streamed
+	sender.sendRecord(&service.Record{RecordType: &service.Record_History{
+		History: &service.HistoryRecord{Item: []*service.HistoryItem{{Key: "_step", ValueJson: "1"}}}}})
+	sender.sendRecord(&service.Record{RecordType: &service.Record_Summary{
+		Summary: &service.SummaryRecord{Update: []*service.SummaryItem{{Key: "a", ValueJson: "1"}}}}})
+
+	assert.Equal(t, service.DeferRequest_FLUSH_FINAL, (<-sender.recordChan).GetRequest().GetDefer().GetState())
+	assert.True(t, sender.status.pollExit().Done)
+}
+
+func TestSendAfterFlushFP(t *testing.T) {
+	sender := makeSender(nil, make(chan *service.Result, 1))
+	sender.recordChan = make(chan *service.Record, 1)
+	sender.graphqlClient = graphql.NewClient("http://localhost", nil)
+	sender.uploader = uploader.NewUploader(context.Background(), sender.logger, uploader.Options{})
+	sender.uploader.Start()
+
+	sender.sendDefer(&service.DeferRequest{State: service.DeferRequest_FLUSH_FP})
+	// files still coming while the uploader closes are reported as failed
+	sender.sendRecord(&service.Record{RecordType: &service.Record_Files{
+		Files: &service.FilesRecord{Files: []*service.FilesItem{
+			{Path: "late.txt", Policy: service.FilesItem_NOW}}}}})
+
+	assert.Equal(t, service.DeferRequest_JOIN_FP, (<-sender.recordChan).GetRequest().GetDefer().GetState())
+	assert.Equal(t, []string{"late.txt"}, sender.status.failed())
+}
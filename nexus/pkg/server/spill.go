@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+)
+
+const (
+	// spillMemorySize is how many bytes of requests are kept in memory
+	// before they are spilled to disk
+	spillMemorySize = 16 * 1024 * 1024
+
+	// spillDiskSize is how many bytes of requests are kept on disk before
+	// new ones are dropped
+	spillDiskSize = 1024 * 1024 * 1024
+)
+
+var errSpillFull = errors.New("filestream: spill buffer is full")
+
+// spillBuffer is a queue of requests waiting to be sent. Requests are kept
+// in memory up to a size, then on disk up to a size, then dropped. The
+// requests come out in the order they went in.
+type spillBuffer struct {
+	// dir is where the disk file is created, the temp dir if it is empty
+	dir string
+
+	// maxMemory and maxDisk are how many bytes are kept in memory and on disk
+	maxMemory int
+	maxDisk   int64
+
+	// mutex protects the buffer and cond signals changes to it
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	// memory are the oldest requests, all older than the ones on disk
+	memory     [][]byte
+	memorySize int
+
+	// file has the requests spilled to disk, each prefixed by its length,
+	// from readOffset to writeOffset
+	file        *os.File
+	readOffset  int64
+	writeOffset int64
+	diskCount   int
+
+	// dropped is how many requests were dropped because the buffer was full
+	dropped int
+
+	// closed is whether no more requests are pushed
+	closed bool
+}
+
+func newSpillBuffer(dir string, maxMemory int, maxDisk int64) *spillBuffer {
+	sb := &spillBuffer{dir: dir, maxMemory: maxMemory, maxDisk: maxDisk}
+	sb.cond = sync.NewCond(&sb.mutex)
+	return sb
+}
+
+// push adds a request to the end of the buffer. It returns an error if the
+// request had to be dropped.
+func (sb *spillBuffer) push(data []byte) error {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	defer sb.cond.Signal()
+
+	if sb.diskCount == 0 && sb.memorySize+len(data) <= sb.maxMemory {
+		sb.memory = append(sb.memory, data)
+		sb.memorySize += len(data)
+		return nil
+	}
+	if sb.writeOffset-sb.readOffset+int64(4+len(data)) > sb.maxDisk {
+		sb.dropped++
+		return errSpillFull
+	}
+	if sb.file == nil {
+		file, err := os.CreateTemp(sb.dir, "wandb-filestream-*.spill")
+		if err != nil {
+			sb.dropped++
+			return err
+		}
+		sb.file = file
+	}
+	record := make([]byte, 4+len(data))
+	binary.LittleEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+	if _, err := sb.file.WriteAt(record, sb.writeOffset); err != nil {
+		sb.dropped++
+		return err
+	}
+	sb.writeOffset += int64(len(record))
+	sb.diskCount++
+	return nil
+}
+
+// next waits for a request and returns it without removing it. It returns
+// false once the buffer is closed and empty.
+func (sb *spillBuffer) next() ([]byte, bool, error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	for len(sb.memory) == 0 && sb.diskCount == 0 {
+		if sb.closed {
+			return nil, false, nil
+		}
+		sb.cond.Wait()
+	}
+	if len(sb.memory) > 0 {
+		return sb.memory[0], true, nil
+	}
+	data, err := sb.readDisk()
+	return data, true, err
+}
+
+// readDisk reads the oldest request on disk
+func (sb *spillBuffer) readDisk() ([]byte, error) {
+	var size [4]byte
+	if _, err := sb.file.ReadAt(size[:], sb.readOffset); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(size[:]))
+	if _, err := sb.file.ReadAt(data, sb.readOffset+4); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// remove removes the request returned by next
+func (sb *spillBuffer) remove() {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if len(sb.memory) > 0 {
+		sb.memorySize -= len(sb.memory[0])
+		sb.memory[0] = nil
+		sb.memory = sb.memory[1:]
+		return
+	}
+	if sb.diskCount == 0 {
+		return
+	}
+	var size [4]byte
+	if _, err := sb.file.ReadAt(size[:], sb.readOffset); err != nil {
+		// the file can't be read, so none of it can be sent
+		sb.dropped += sb.diskCount
+		sb.resetDisk()
+		return
+	}
+	sb.readOffset += 4 + int64(binary.LittleEndian.Uint32(size[:]))
+	sb.diskCount--
+	if sb.diskCount == 0 {
+		sb.resetDisk()
+	}
+}
+
+// resetDisk empties the disk file so it doesn't grow forever
+func (sb *spillBuffer) resetDisk() {
+	sb.readOffset, sb.writeOffset, sb.diskCount = 0, 0, 0
+	_ = sb.file.Truncate(0)
+}
+
+// len returns how many requests are in the buffer
+func (sb *spillBuffer) len() int {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return len(sb.memory) + sb.diskCount
+}
+
+// clear drops all the requests in the buffer and returns how many there were
+func (sb *spillBuffer) clear() int {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	n := len(sb.memory) + sb.diskCount
+	sb.dropped += n
+	sb.memory, sb.memorySize = nil, 0
+	if sb.file != nil {
+		sb.resetDisk()
+	}
+	return n
+}
+
+// close stops pushing requests, next returns false once the buffer is empty
+func (sb *spillBuffer) close() {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	sb.closed = true
+	sb.cond.Broadcast()
+}
+
+// release closes the disk file once the buffer is no longer used
+func (sb *spillBuffer) release() {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if sb.file != nil {
+		_ = sb.file.Close()
+		_ = os.Remove(sb.file.Name())
+		sb.file = nil
+	}
+}
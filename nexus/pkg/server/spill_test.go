@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	sb := newSpillBuffer(t.TempDir(), 10, 24)
+	defer sb.release()
+
+	// two requests fit in memory, the next ones go to disk until it is full
+	for i := 0; i < 6; i++ {
+		err := sb.push([]byte(fmt.Sprintf("req%d", i)))
+		if i < 5 {
+			assert.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, errSpillFull)
+		}
+	}
+	assert.Equal(t, 5, sb.len())
+	assert.Equal(t, 1, sb.dropped)
+
+	// requests come out in order, from memory then disk
+	sb.close()
+	var got []string
+	for {
+		data, ok, err := sb.next()
+		if !ok {
+			break
+		}
+		assert.NoError(t, err)
+		got = append(got, string(data))
+		sb.remove()
+		if len(got) == 3 {
+			// once memory has room again, newer requests still wait for
+			// the ones on disk
+			sb.mutex.Lock()
+			sb.closed = false
+			sb.mutex.Unlock()
+			assert.NoError(t, sb.push([]byte("req6")))
+			sb.close()
+		}
+	}
+	assert.Equal(t, []string{"req0", "req1", "req2", "req3", "req4", "req6"}, got)
+}
+
+func TestFileStreamRetry(t *testing.T) {
+	mutex := sync.Mutex{}
+	failures := 2
+	var lines []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var data FsData
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&data))
+		if chunk, ok := data.Files[HistoryFileName]; ok {
+			// lines are sent in order from where the last request stopped
+			assert.Equal(t, len(lines), chunk.Offset)
+			lines = append(lines, chunk.Content...)
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	fs := NewFileStream(server.URL, &service.Settings{}, logger)
+	fs.httpClient.RetryMax = 0
+	fs.backoffMin = time.Millisecond
+	fs.backoffMax = time.Millisecond
+	fs.Start()
+
+	for i := 0; i < 3; i++ {
+		fs.StreamRecord(&service.Record{RecordType: &service.Record_History{
+			History: &service.HistoryRecord{
+				Item: []*service.HistoryItem{{Key: "_step", ValueJson: fmt.Sprintf("%d", i)}},
+			}}})
+		time.Sleep(5 * delayProcess)
+	}
+	fs.Close()
+
+	assert.Equal(t, []string{`{"_step":0}`, `{"_step":1}`, `{"_step":2}`}, lines)
+	status := fs.NetworkStatus()
+	assert.Len(t, status, 2)
+	assert.Equal(t, int32(http.StatusServiceUnavailable), status[0].HttpStatusCode)
+	assert.Equal(t, int32(0), status[1].HttpStatusCode)
+}
+
+func TestFileStreamCloseTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	fs := NewFileStream(server.URL, &service.Settings{}, logger)
+	fs.httpClient.RetryMax = 0
+	fs.backoffMin = time.Millisecond
+	fs.closeTimeout = 50 * time.Millisecond
+	fs.Start()
+	fs.StreamRecord(&service.Record{RecordType: &service.Record_Exit{Exit: &service.RunExitRecord{}}})
+
+	// closing doesn't wait forever for a server that can't be reached
+	fs.Close()
+	assert.Equal(t, 0, fs.spill.len())
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
+	bolt "go.etcd.io/bbolt"
+)
+
+// stateBackendEnv selects where state that grows with the number of
+// distinct keys of a run is kept, "memory" (the default) or "disk"
+const stateBackendEnv = "WANDB_NEXUS_STATE"
+
+// StateStore is a string key value store for state that grows with the
+// number of distinct keys logged by a run, like the consolidated summary.
+// Errors are captured by the store, a failed write loses the key.
+type StateStore interface {
+	// Get returns the value of key and whether it is set
+	Get(key string) (string, bool)
+
+	// Set sets the value of key
+	Set(key string, value string)
+
+	// Delete removes key
+	Delete(key string)
+
+	// Range calls fn for each key in key order until fn returns false
+	Range(fn func(key string, value string) bool)
+
+	// Close releases the store and any file it created
+	Close()
+}
+
+// NewStateStore creates the state store named name for a stream. With the
+// disk backend it is kept in a file next to the sync file, otherwise or if
+// that file can't be created it is kept in memory.
+func NewStateStore(settings *service.Settings, name string, logger *observability.NexusLogger) StateStore {
+	backend := os.Getenv(stateBackendEnv)
+	switch backend {
+	case "", "memory":
+		return NewMemoryStateStore()
+	case "disk":
+		syncFile := settings.GetSyncFile().GetValue()
+		if syncFile == "" {
+			logger.Warn("state: no sync file, keeping state in memory", "name", name)
+			return NewMemoryStateStore()
+		}
+		store, err := NewDiskStateStore(fmt.Sprintf("%s.%s.state", syncFile, name), logger)
+		if err != nil {
+			logger.CaptureError("state: can't create disk state, keeping state in memory", err, "name", name)
+			return NewMemoryStateStore()
+		}
+		return store
+	default:
+		logger.CaptureError("state: unknown backend, keeping state in memory",
+			fmt.Errorf("state: unknown backend %q", backend))
+		return NewMemoryStateStore()
+	}
+}
+
+// MemoryStateStore is a StateStore backed by a map
+type MemoryStateStore struct {
+	values map[string]string
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{values: make(map[string]string)}
+}
+
+func (m *MemoryStateStore) Get(key string) (string, bool) {
+	value, ok := m.values[key]
+	return value, ok
+}
+
+func (m *MemoryStateStore) Set(key string, value string) {
+	m.values[key] = value
+}
+
+func (m *MemoryStateStore) Delete(key string) {
+	delete(m.values, key)
+}
+
+func (m *MemoryStateStore) Range(fn func(key string, value string) bool) {
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, m.values[key]) {
+			return
+		}
+	}
+}
+
+func (m *MemoryStateStore) Close() {}
+
+// stateBucket is the bolt bucket holding the keys
+var stateBucket = []byte("state")
+
+// stateBatchSize is the number of updates buffered before they are
+// written in a single transaction
+const stateBatchSize = 1024
+
+// DiskStateStore is a StateStore backed by a bolt database, so that memory
+// stays flat regardless of the number of keys. The database only lives as
+// long as the stream, it is recreated when opened and removed when closed.
+type DiskStateStore struct {
+	// db is the bolt database
+	db *bolt.DB
+
+	// fileName is the file of the database
+	fileName string
+
+	// pending are the buffered updates, a nil value deletes the key
+	pending map[string]*string
+
+	// logger is the logger for the store
+	logger *observability.NexusLogger
+}
+
+func NewDiskStateStore(fileName string, logger *observability.NexusLogger) (*DiskStateStore, error) {
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// the database is removed when it is opened, so it never outlives the
+	// stream and there is no need to sync every update
+	db, err := bolt.Open(fileName, 0600, &bolt.Options{NoSync: true, NoFreelistSync: true})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket(stateBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &DiskStateStore{
+		db:       db,
+		fileName: fileName,
+		pending:  make(map[string]*string),
+		logger:   logger,
+	}, nil
+}
+
+func (d *DiskStateStore) Get(key string) (string, bool) {
+	if value, ok := d.pending[key]; ok {
+		if value == nil {
+			return "", false
+		}
+		return *value, true
+	}
+	var value []byte
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(stateBucket).Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		d.logger.CaptureError("state: can't get key", err, "key", key)
+	}
+	return string(value), value != nil
+}
+
+func (d *DiskStateStore) Set(key string, value string) {
+	d.pending[key] = &value
+	if len(d.pending) >= stateBatchSize {
+		d.flush()
+	}
+}
+
+func (d *DiskStateStore) Delete(key string) {
+	d.pending[key] = nil
+	if len(d.pending) >= stateBatchSize {
+		d.flush()
+	}
+}
+
+// flush writes the pending updates to the database
+func (d *DiskStateStore) flush() {
+	if len(d.pending) == 0 {
+		return
+	}
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateBucket)
+		for key, value := range d.pending {
+			var err error
+			if value == nil {
+				err = bucket.Delete([]byte(key))
+			} else {
+				err = bucket.Put([]byte(key), []byte(*value))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		d.logger.CaptureError("state: can't write keys", err, "count", len(d.pending))
+	}
+	d.pending = make(map[string]*string)
+}
+
+func (d *DiskStateStore) Range(fn func(key string, value string) bool) {
+	d.flush()
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(stateBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !fn(string(k), string(v)) {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		d.logger.CaptureError("state: can't iterate keys", err)
+	}
+}
+
+func (d *DiskStateStore) Close() {
+	if err := d.db.Close(); err != nil {
+		d.logger.CaptureError("state: can't close", err)
+	}
+	if err := os.Remove(d.fileName); err != nil {
+		d.logger.CaptureError("state: can't remove", err)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+)
+
+func TestStateStore(t *testing.T) {
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	fileName := filepath.Join(t.TempDir(), "test.state")
+	disk, err := NewDiskStateStore(fileName, logger)
+	assert.NoError(t, err)
+
+	for name, store := range map[string]StateStore{"memory": NewMemoryStateStore(), "disk": disk} {
+		t.Run(name, func(t *testing.T) {
+			num := stateBatchSize + 10
+			for i := 0; i < num; i++ {
+				store.Set(fmt.Sprintf("key%05d", i), fmt.Sprintf("%d", i))
+			}
+			store.Delete("key00001")
+			store.Set("key00002", "updated")
+
+			value, ok := store.Get("key00002")
+			assert.True(t, ok)
+			assert.Equal(t, "updated", value)
+			_, ok = store.Get("key00001")
+			assert.False(t, ok)
+
+			var keys []string
+			store.Range(func(key string, value string) bool {
+				keys = append(keys, key)
+				return true
+			})
+			assert.Len(t, keys, num-1)
+			assert.Equal(t, "key00000", keys[0])
+			assert.Equal(t, "key00002", keys[1])
+			store.Close()
+		})
+	}
+	_, err = os.Stat(fileName)
+	assert.True(t, os.IsNotExist(err))
+}
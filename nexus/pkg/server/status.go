@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/wandb/wandb/nexus/internal/uploader"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+// runStatus is what the sender publishes about the progress of the run. The
+// handler answers the requests about it from here, so they are answered
+// while the sender is busy and after it is done.
+type runStatus struct {
+	// mutex protects the status
+	mutex sync.Mutex
+
+	// uploader, fileStream and stopPoller are the parts of the run that
+	// report their own progress, set once the run started
+	uploader   *uploader.Uploader
+	fileStream *FileStream
+	stopPoller *stopPoller
+
+	// networkStatus collects the requests to the server that are retried
+	networkStatus *networkStatus
+
+	// uploadFailures are the uploads that failed since the last network
+	// status request, they are reported by the uploader workers
+	uploadFailures []*uploader.UploadResult
+
+	// failedUploads are the names of all the files that failed to upload,
+	// so that the end of the run can report them
+	failedUploads []string
+
+	// done is whether the files were uploaded and the file stream was
+	// flushed at the end of the run
+	done bool
+}
+
+func newRunStatus() *runStatus {
+	return &runStatus{networkStatus: &networkStatus{}}
+}
+
+// start publishes the parts of the run that report their own progress
+func (rs *runStatus) start(uploader *uploader.Uploader, fileStream *FileStream, stopPoller *stopPoller) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.uploader = uploader
+	rs.fileStream = fileStream
+	rs.stopPoller = stopPoller
+}
+
+// uploadFailed keeps a failed upload to report it to the user, by the name
+// of the file in the run
+func (rs *runStatus) uploadFailed(name string, result *uploader.UploadResult) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	result.Path = name
+	rs.uploadFailures = append(rs.uploadFailures, result)
+	rs.failedUploads = append(rs.failedUploads, name)
+}
+
+// failed returns the names of all the files that failed to upload
+func (rs *runStatus) failed() []string {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return append([]string(nil), rs.failedUploads...)
+}
+
+// finish publishes that the run is done syncing
+func (rs *runStatus) finish() {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.done = true
+}
+
+// pollExit returns the progress of the file uploads, and whether the run is
+// done syncing once it exited
+func (rs *runStatus) pollExit() *service.PollExitResponse {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	pollExit := &service.PollExitResponse{
+		PusherStats: &service.FilePusherStats{},
+		FileCounts:  &service.FileCounts{},
+	}
+	if rs.done {
+		pollExit.Done = true
+		pollExit.ExitResult = &service.RunExitResult{}
+	}
+	if rs.uploader != nil {
+		pollExit.PusherStats, pollExit.FileCounts = rs.uploader.Stats()
+	}
+	return pollExit
+}
+
+// networkStatusResponse returns the problems to show the user since the
+// last request, like the file stream failing or files that failed to upload
+func (rs *runStatus) networkStatusResponse() *service.NetworkStatusResponse {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	networkStatus := &service.NetworkStatusResponse{
+		NetworkResponses: rs.networkStatus.drain(),
+	}
+	if rs.fileStream != nil {
+		networkStatus.NetworkResponses = append(networkStatus.NetworkResponses, rs.fileStream.NetworkStatus()...)
+	}
+	for _, failure := range rs.uploadFailures {
+		text := fmt.Sprintf("Failed to upload %s: %v", failure.Path, failure.Err)
+		if failure.Retryable {
+			text = fmt.Sprintf("Failed to upload %s after retrying: %v", failure.Path, failure.Err)
+		}
+		// the client shows the text of responses with no status as is
+		networkStatus.NetworkResponses = append(networkStatus.NetworkResponses,
+			&service.HttpResponse{HttpResponseText: text})
+	}
+	rs.uploadFailures = nil
+	return networkStatus
+}
+
+// stopStatus returns whether the run was asked to stop from the UI
+func (rs *runStatus) stopStatus() *service.StopStatusResponse {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return &service.StopStatusResponse{
+		RunShouldStop: (rs.fileStream != nil && rs.fileStream.StopRequested()) ||
+			(rs.stopPoller != nil && rs.stopPoller.shouldStop()),
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Khan/genqlient/graphql"
+
+	"github.com/wandb/wandb/nexus/internal/gql"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+)
+
+// defaultStopPollingInterval is how often the server is asked whether the run
+// was stopped when no interval is given
+const defaultStopPollingInterval = 15 * time.Second
+
+// StopPollingIntervalFromEnv returns how often the server is asked whether
+// the run was stopped, as set in the environment in seconds.
+//
+// TODO: take it from the settings once they have a field for it, the settings
+// proto has none and is generated from the client.
+func StopPollingIntervalFromEnv() (time.Duration, error) {
+	value := os.Getenv("WANDB_NEXUS_STOP_POLLING_INTERVAL")
+	if value == "" {
+		return defaultStopPollingInterval, nil
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds <= 0 {
+		return defaultStopPollingInterval, fmt.Errorf("stoppoller: invalid polling interval %q", value)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// stopPoller asks the server in the background whether the run was stopped
+// from the UI, and keeps the last answer
+type stopPoller struct {
+	// ctx is the context for the requests
+	ctx context.Context
+
+	// logger is the logger for the poller
+	logger *observability.NexusLogger
+
+	// graphqlClient is the client the server is asked with
+	graphqlClient graphql.Client
+
+	// entity, project and runId are the run that is asked about
+	entity  string
+	project string
+	runId   string
+
+	// interval is how often the server is asked
+	interval time.Duration
+
+	// stopped is whether the server answered that the run was stopped
+	stopped atomic.Bool
+
+	// done is closed to stop polling
+	done chan struct{}
+
+	// wg is the wait group for the polling goroutine
+	wg sync.WaitGroup
+
+	// once makes stop safe to call more than once
+	once sync.Once
+}
+
+func newStopPoller(
+	ctx context.Context,
+	logger *observability.NexusLogger,
+	graphqlClient graphql.Client,
+	entity, project, runId string,
+	interval time.Duration,
+) *stopPoller {
+	return &stopPoller{
+		ctx:           ctx,
+		logger:        logger,
+		graphqlClient: graphqlClient,
+		entity:        entity,
+		project:       project,
+		runId:         runId,
+		interval:      interval,
+		done:          make(chan struct{}),
+	}
+}
+
+// start starts polling the server
+func (sp *stopPoller) start() {
+	sp.wg.Add(1)
+	go func() {
+		defer sp.wg.Done()
+		ticker := time.NewTicker(sp.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sp.poll()
+			case <-sp.done:
+				return
+			}
+		}
+	}()
+}
+
+// poll asks the server whether the run was stopped
+func (sp *stopPoller) poll() {
+	ctx, cancel := context.WithTimeout(sp.ctx, sp.interval)
+	defer cancel()
+	resp, err := gql.RunStoppedStatus(ctx, sp.graphqlClient, &sp.entity, &sp.project, sp.runId)
+	if err != nil {
+		// the last answer is kept until the server can be asked again
+		sp.logger.Warn("stoppoller: error polling stop status", "error", err)
+		return
+	}
+	project := resp.GetProject()
+	if project == nil || project.GetRun() == nil {
+		return
+	}
+	stopped := project.GetRun().GetStopped()
+	if stopped != nil && *stopped && !sp.stopped.Swap(true) {
+		sp.logger.Info("stoppoller: run stop requested", "run_id", sp.runId)
+	}
+}
+
+// shouldStop returns whether the server answered that the run was stopped
+func (sp *stopPoller) shouldStop() bool {
+	return sp.stopped.Load()
+}
+
+// stop stops polling the server
+func (sp *stopPoller) stop() {
+	sp.once.Do(func() {
+		close(sp.done)
+		sp.wg.Wait()
+	})
+}
@@ -4,7 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/wandb/wandb/nexus/pkg/observability"
 
@@ -13,50 +18,238 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+const (
+	// headerMagic is the magic number of the transaction log header
+	headerMagic uint16 = 0xBEE1
+
+	// headerVersion is the version of the transaction log format,
+	// it is stored in the low nibble of the header version byte
+	headerVersion byte = 0
+)
+
+// headerIdent is the identifier at the start of every transaction log
+var headerIdent = [4]byte{byte(':'), byte('W'), byte('&'), byte('B')}
+
+// StoreHeader is the header at the start of a transaction log file
+type StoreHeader struct {
+	Ident   [4]byte
+	Magic   uint16
+	Version byte
+}
+
+// StoreOptions are the options for writing a transaction log, when
+// reading they are taken from the header of each segment
+type StoreOptions struct {
+	// Compression is the compression applied to each record
+	Compression Compression
+
+	// MaxSegmentSize is the size in bytes after which the log is continued
+	// in a new segment file, 0 means the log is never rotated
+	MaxSegmentSize int64
+
+	// Key is the AES key the records are encrypted with, nil means the
+	// records are not encrypted. Encrypted logs can be read without it
+	// if the key is set in the environment.
+	Key []byte
+}
+
+// StoreOptionsFromEnv returns the store options set in the environment.
+// Each option is parsed on its own, the ones that are invalid are left to
+// their defaults and reported in the error, except for the key: a log that
+// should be encrypted must not be written in plaintext, so an invalid key
+// is returned as a StoreKeyError for the caller to refuse to write.
+func StoreOptionsFromEnv() (StoreOptions, error) {
+	options := StoreOptions{}
+	var errs []error
+	compression, err := ParseCompression(os.Getenv("WANDB_NEXUS_STORE_COMPRESSION"))
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		options.Compression = compression
+	}
+	if size := os.Getenv("WANDB_NEXUS_STORE_SEGMENT_SIZE"); size != "" {
+		if segmentSize, err := strconv.ParseInt(size, 10, 64); err != nil {
+			errs = append(errs, fmt.Errorf("store: invalid segment size %q: %w", size, err))
+		} else {
+			options.MaxSegmentSize = segmentSize
+		}
+	}
+	if options.Key, err = storeKeyFromEnv(); err != nil {
+		errs = append(errs, &StoreKeyError{Err: err})
+	}
+	return options, errors.Join(errs...)
+}
+
+// StoreKeyError is the error of a store key that is set but can't be used
+type StoreKeyError struct {
+	Err error
+}
+
+func (e *StoreKeyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StoreKeyError) Unwrap() error {
+	return e.Err
+}
+
 // Store is the persistent store for a stream
 type Store struct {
 	// ctx is the context for the store
 	ctx context.Context
 
+	// name is the name of the underlying file, which is also
+	// the name of the first segment of the log
+	name string
+
+	// options are the options for writing the log
+	options StoreOptions
+
 	// writer is the underlying writer
 	writer *leveldb.Writer
 
-	// db is the underlying database
+	// reader is the underlying reader
+	reader *leveldb.Reader
+
+	// db is the underlying database, the file of the current segment
 	db *os.File
 
+	// segment is the index of the current segment
+	segment int
+
+	// readOffset is the offset in the log of the start of the current
+	// segment when reading, counting the blocks of the segments before it
+	readOffset int64
+
+	// segmentSize is the number of bytes of the records in the current
+	// segment, without the header and the framing of the blocks
+	segmentSize int64
+
+	// codec compresses the records of the current segment
+	codec codec
+
 	// logger is the logger for the store
 	logger *observability.NexusLogger
 }
 
 // NewStore creates a new store
-func NewStore(ctx context.Context, fileName string, logger *observability.NexusLogger) (*Store, error) {
-	f, err := os.Create(fileName)
-	if err != nil {
-		logger.CaptureError("can't write header", err)
-		return nil, err
-	}
-	writer := leveldb.NewWriterExt(f, leveldb.CRCAlgoIEEE)
+func NewStore(ctx context.Context, fileName string, logger *observability.NexusLogger) *Store {
 	sr := &Store{ctx: ctx,
-		writer: writer,
-		db:     f,
+		name:   fileName,
 		logger: logger,
 	}
-	if err = sr.addHeader(); err != nil {
-		sr.logger.CaptureError("can't write header", err)
-		return nil, err
+	return sr
+}
+
+// SetOptions sets the options for writing the log, it has to be called before Open
+func (sr *Store) SetOptions(options StoreOptions) {
+	sr.options = options
+}
+
+// segmentName returns the file name of a segment of the log
+func (sr *Store) segmentName(segment int) string {
+	if segment == 0 {
+		return sr.name
 	}
-	return sr, nil
+	return fmt.Sprintf("%s.%d", sr.name, segment)
 }
 
-func (sr *Store) addHeader() error {
-	type Header struct {
-		ident   [4]byte
-		magic   uint16
-		version byte
+// Open opens the store for reading (os.O_RDONLY), writing (os.O_WRONLY)
+// or appending to an existing log (os.O_WRONLY|os.O_APPEND)
+func (sr *Store) Open(flag int) error {
+	switch flag {
+	case os.O_RDONLY:
+		if err := sr.openSegmentReader(0); err != nil {
+			sr.logger.CaptureError("can't open store", err)
+			return err
+		}
+	case os.O_WRONLY:
+		if err := sr.createSegment(0); err != nil {
+			sr.logger.CaptureError("can't write header", err)
+			return err
+		}
+	case os.O_WRONLY | os.O_APPEND:
+		// continue in the last segment that was written
+		segment := 0
+		for {
+			if _, err := os.Stat(sr.segmentName(segment + 1)); err != nil {
+				break
+			}
+			segment++
+		}
+		f, err := os.OpenFile(sr.segmentName(segment), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			sr.logger.CaptureError("can't open file", err)
+			return err
+		}
+		sr.db = f
+		sr.segment = segment
+		if err = sr.recoverTail(); err != nil {
+			sr.logger.CaptureError("can't recover log", err)
+			_ = sr.db.Close()
+			return err
+		}
+		sr.writer = leveldb.NewWriterExt(sr.db, leveldb.CRCAlgoIEEE)
+	default:
+		err := fmt.Errorf("store: invalid flag %d", flag)
+		sr.logger.CaptureError("can't open store", err)
+		return err
+	}
+	return nil
+}
+
+// openSegmentReader opens a segment of the log for reading
+func (sr *Store) openSegmentReader(segment int) error {
+	f, err := os.Open(sr.segmentName(segment))
+	if err != nil {
+		return err
+	}
+	sr.db = f
+	sr.segment = segment
+	if err = sr.readHeader(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	sr.reader = leveldb.NewReaderExt(f, leveldb.CRCAlgoIEEE)
+	return nil
+}
+
+// createSegment creates a new segment of the log for writing
+func (sr *Store) createSegment(segment int) error {
+	f, err := os.Create(sr.segmentName(segment))
+	if err != nil {
+		return err
 	}
+	sr.db = f
+	sr.segment = segment
+	sr.segmentSize = 0
+	sr.codec.compression = sr.options.Compression
+	if err = sr.codec.setKey(sr.options.Key); err != nil {
+		return err
+	}
+	sr.writer = leveldb.NewWriterExt(f, leveldb.CRCAlgoIEEE)
+	return sr.addHeader()
+}
+
+// rotate closes the current segment and continues the log in a new one
+func (sr *Store) rotate() error {
+	if err := sr.writer.Close(); err != nil {
+		return err
+	}
+	if err := sr.db.Close(); err != nil {
+		return err
+	}
+	sr.logger.Info("store: rotating log", "file", sr.name, "segment", sr.segment+1)
+	return sr.createSegment(sr.segment + 1)
+}
+
+func (sr *Store) addHeader() error {
 	buf := new(bytes.Buffer)
-	ident := [4]byte{byte(':'), byte('W'), byte('&'), byte('B')}
-	head := Header{ident: ident, magic: 0xBEE1, version: 0}
+	version := headerVersion | byte(sr.codec.compression)<<4
+	if sr.codec.aead != nil {
+		version |= headerEncrypted
+	}
+	head := StoreHeader{Ident: headerIdent, Magic: headerMagic, Version: version}
 	if err := binary.Write(buf, binary.LittleEndian, &head); err != nil {
 		sr.logger.CaptureError("can't write header", err)
 		return err
@@ -68,9 +261,137 @@ func (sr *Store) addHeader() error {
 	return nil
 }
 
+// readHeader reads the header written by addHeader and verifies
+// that the file is a transaction log we know how to read
+func (sr *Store) readHeader() error {
+	head := StoreHeader{}
+	if err := binary.Read(sr.db, binary.LittleEndian, &head); err != nil {
+		return fmt.Errorf("store: can't read header: %w", err)
+	}
+	if head.Ident != headerIdent {
+		return fmt.Errorf("store: invalid header ident %q", head.Ident[:])
+	}
+	if head.Magic != headerMagic {
+		return fmt.Errorf("store: invalid header magic %#x", head.Magic)
+	}
+	if head.Version&0x0f != headerVersion {
+		return fmt.Errorf("store: unsupported header version %d", head.Version&0x0f)
+	}
+	compression := Compression(head.Version &^ headerEncrypted >> 4)
+	if compression > CompressionSnappy {
+		return fmt.Errorf("store: unsupported compression %v", compression)
+	}
+	sr.codec.compression = compression
+
+	if head.Version&headerEncrypted == 0 {
+		return sr.codec.setKey(nil)
+	}
+	key := sr.options.Key
+	if key == nil {
+		var err error
+		if key, err = storeKeyFromEnv(); err != nil {
+			return err
+		}
+	}
+	if key == nil {
+		return ErrStoreKeyMissing
+	}
+	return sr.codec.setKey(key)
+}
+
+// recoverTail prepares an existing log to be appended to. It finds the end
+// of the last valid record, drops whatever follows it (e.g. a block torn
+// by a crash) and leaves the file positioned at the start of a new block.
+// An empty file just gets a new header.
+func (sr *Store) recoverTail() error {
+	info, err := sr.db.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		sr.codec.compression = sr.options.Compression
+		if err = sr.codec.setKey(sr.options.Key); err != nil {
+			return err
+		}
+		return sr.addHeader()
+	}
+	// the records we append have to use the compression and encryption of
+	// the segment, a segment we can't read is kept aside and the log starts
+	// over in a new one
+	if err = sr.readHeader(); err != nil {
+		return sr.replaceSegment(err)
+	}
+
+	// the leveldb blocks start right after the header
+	start := int64(binary.Size(StoreHeader{}))
+	reader := leveldb.NewReaderExt(io.NewSectionReader(sr.db, start, info.Size()-start), leveldb.CRCAlgoIEEE)
+	var end, size int64
+	var records, corrupted int
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var n int64
+		if err == nil {
+			n, err = io.Copy(io.Discard, record)
+		}
+		if err != nil {
+			// skip to the next good block, everything from the
+			// last valid record onwards is truncated below
+			corrupted++
+			reader.Recover()
+			continue
+		}
+		end = reader.Offset()
+		size += n
+		records++
+	}
+
+	if err = sr.db.Truncate(start + end); err != nil {
+		return err
+	}
+	// pad the last block with zeroes, which the reader skips over, so that
+	// the new writer's blocks stay aligned with the existing ones
+	if rem := end % leveldb.BlockSize; rem != 0 {
+		end += leveldb.BlockSize - rem
+		if err = sr.db.Truncate(start + end); err != nil {
+			return err
+		}
+	}
+	if _, err = sr.db.Seek(start+end, io.SeekStart); err != nil {
+		return err
+	}
+	sr.segmentSize = size
+	sr.logger.Info("store: recovered log",
+		"file", sr.db.Name(), "records", records, "corrupted", corrupted, "size", info.Size(), "offset", start+end)
+	return nil
+}
+
+// replaceSegment moves the current segment, which can't be appended to
+// because of err, out of the way and starts it over
+func (sr *Store) replaceSegment(err error) error {
+	name := sr.db.Name()
+	aside := fmt.Sprintf("%s.invalid-%d", name, time.Now().UnixNano())
+	sr.logger.CaptureWarn("store: can't append to log, starting a new one",
+		"file", name, "moved", aside, "error", err)
+	if err := sr.db.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(name, aside); err != nil {
+		return err
+	}
+	return sr.createSegment(sr.segment)
+}
+
 func (sr *Store) Close() error {
-	err := sr.writer.Close()
-	return err
+	defer sr.codec.close()
+	if sr.writer != nil {
+		if err := sr.writer.Close(); err != nil {
+			return err
+		}
+	}
+	return sr.db.Close()
 }
 
 func (sr *Store) storeRecord(msg *service.Record) error {
@@ -84,10 +405,119 @@ func (sr *Store) storeRecord(msg *service.Record) error {
 		sr.logger.CaptureError("can't write header", err)
 		return err
 	}
+	if out, err = sr.codec.compress(out); err != nil {
+		sr.logger.CaptureError("can't compress record", err)
+		return err
+	}
+	if out, err = sr.codec.seal(out); err != nil {
+		sr.logger.CaptureError("can't encrypt record", err)
+		return err
+	}
 
 	if _, err = writer.Write(out); err != nil {
 		sr.logger.CaptureError("can't write header", err)
 		return err
 	}
+	sr.segmentSize += int64(len(out))
+
+	if sr.options.MaxSegmentSize > 0 && sr.segmentSize >= sr.options.MaxSegmentSize {
+		if err = sr.rotate(); err != nil {
+			sr.logger.CaptureError("can't rotate log", err)
+			return err
+		}
+	}
 	return nil
 }
+
+// Recover clears a read error, so that the next Read continues
+// from the next good block of the log
+func (sr *Store) Recover() {
+	sr.reader.Recover()
+}
+
+// RecordError is the error of a record that was read whole but could not
+// be unmarshaled, Data are its bytes
+type RecordError struct {
+	Data []byte
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("can't unmarshal record: %v", e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// ChunkError is the error of a record whose chunks are corrupted, e.g.
+// their checksum doesn't match or they were torn by a crash
+type ChunkError struct {
+	Err error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("corrupted record: %v", e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// Read reads the next record from the store, continuing with the next
+// segment at the end of each one. It returns io.EOF when there are no
+// more records, a ChunkError when the chunks of a record are corrupted and
+// a RecordError when a record can't be unmarshaled.
+func (sr *Store) Read() (*service.Record, error) {
+	reader, err := sr.reader.Next()
+	for errors.Is(err, io.EOF) {
+		if _, statErr := os.Stat(sr.segmentName(sr.segment + 1)); statErr != nil {
+			return nil, err
+		}
+		sr.readOffset += sr.reader.Offset()
+		if err = sr.db.Close(); err != nil {
+			return nil, err
+		}
+		if err = sr.openSegmentReader(sr.segment + 1); err != nil {
+			sr.logger.CaptureError("can't open segment", err)
+			return nil, err
+		}
+		reader, err = sr.reader.Next()
+	}
+	if err != nil {
+		return nil, &ChunkError{Err: err}
+	}
+	buf, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, &ChunkError{Err: err}
+	}
+	if buf, err = sr.codec.open(buf); err != nil {
+		sr.logger.CaptureError("can't decrypt record", err)
+		return nil, err
+	}
+	if buf, err = sr.codec.decompress(buf); err != nil {
+		sr.logger.CaptureError("can't decompress record", err)
+		return nil, err
+	}
+	msg := &service.Record{}
+	if err = proto.Unmarshal(buf, msg); err != nil {
+		sr.logger.CaptureError("can't unmarshal record", err)
+		return nil, &RecordError{Data: buf, Err: err}
+	}
+	return msg, nil
+}
+
+// Offset returns the offset in the log just past the last record read, the
+// blocks of all the segments read so far are counted but not their headers
+func (sr *Store) Offset() int64 {
+	return sr.readOffset + sr.reader.Offset()
+}
+
+// Sync writes out the records buffered in the current block and commits
+// the log to stable storage
+func (sr *Store) Sync() error {
+	if err := sr.writer.Flush(); err != nil {
+		return err
+	}
+	return sr.db.Sync()
+}
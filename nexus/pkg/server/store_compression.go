@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/cipher"
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the compression applied to each record in the transaction log,
+// it is recorded in bits 4 to 6 of the header version byte
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionZstd
+	CompressionSnappy
+)
+
+// ParseCompression parses the name of a compression, an empty name means none
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "zstd":
+		return CompressionZstd, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	default:
+		return CompressionNone, fmt.Errorf("store: unknown compression %q", name)
+	}
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionSnappy:
+		return "snappy"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+// codec compresses and encrypts records, the zstd encoder and
+// decoder are created on first use as they allocate sizeable buffers
+type codec struct {
+	compression Compression
+	encoder     *zstd.Encoder
+	decoder     *zstd.Decoder
+
+	// aead encrypts the records, it is nil if they are not encrypted
+	aead cipher.AEAD
+}
+
+func (c *codec) compress(data []byte) ([]byte, error) {
+	switch c.compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionZstd:
+		if c.encoder == nil {
+			encoder, err := zstd.NewWriter(nil)
+			if err != nil {
+				return nil, err
+			}
+			c.encoder = encoder
+		}
+		return c.encoder.EncodeAll(data, nil), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	default:
+		return nil, fmt.Errorf("store: unknown compression %v", c.compression)
+	}
+}
+
+func (c *codec) decompress(data []byte) ([]byte, error) {
+	switch c.compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionZstd:
+		if c.decoder == nil {
+			decoder, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			c.decoder = decoder
+		}
+		return c.decoder.DecodeAll(data, nil)
+	case CompressionSnappy:
+		return snappy.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("store: unknown compression %v", c.compression)
+	}
+}
+
+// close releases the resources held by the zstd encoder and decoder
+func (c *codec) close() {
+	if c.encoder != nil {
+		_ = c.encoder.Close()
+		c.encoder = nil
+	}
+	if c.decoder != nil {
+		c.decoder.Close()
+		c.decoder = nil
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// headerEncrypted is set in the header version byte when the records
+// of the log are encrypted with AES-GCM
+const headerEncrypted byte = 0x80
+
+// storeKeyEnv is the environment variable holding the base64 encoded
+// AES key of encrypted transaction logs
+const storeKeyEnv = "WANDB_NEXUS_STORE_KEY"
+
+// ErrStoreKeyMissing is returned when opening an encrypted log without a key
+var ErrStoreKeyMissing = errors.New("store: log is encrypted but no key is set, set " + storeKeyEnv)
+
+// ParseStoreKey decodes a base64 encoded AES-128, AES-192 or AES-256 key
+func ParseStoreKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("store: invalid key: %w", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("store: invalid key size %d, expected 16, 24 or 32 bytes", len(key))
+	}
+}
+
+// storeKeyFromEnv returns the key set in the environment, or nil if there is none
+func storeKeyFromEnv() ([]byte, error) {
+	s := os.Getenv(storeKeyEnv)
+	if s == "" {
+		return nil, nil
+	}
+	return ParseStoreKey(s)
+}
+
+// setKey sets the key used to encrypt and decrypt records, a nil key
+// disables encryption
+func (c *codec) setKey(key []byte) error {
+	if key == nil {
+		c.aead = nil
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	c.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// seal encrypts a record, the random nonce is prepended to the ciphertext
+func (c *codec) seal(data []byte) ([]byte, error) {
+	if c.aead == nil {
+		return data, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// open decrypts a record encrypted by seal
+func (c *codec) open(data []byte) ([]byte, error) {
+	if c.aead == nil {
+		return data, nil
+	}
+	if len(data) < c.aead.NonceSize() {
+		return nil, errors.New("store: encrypted record too short")
+	}
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	out, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("store: can't decrypt record, is the key correct? %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
+	"google.golang.org/protobuf/proto"
+)
+
+func makeStore(t *testing.T) *Store {
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	fileName := filepath.Join(t.TempDir(), "test.wandb")
+	return NewStore(context.Background(), fileName, logger)
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	store := makeStore(t)
+	assert.NoError(t, store.Open(os.O_WRONLY))
+	for i := 0; i < 3; i++ {
+		record := &service.Record{
+			RecordType: &service.Record_History{
+				History: &service.HistoryRecord{Step: &service.HistoryStep{Num: int64(i)}},
+			},
+		}
+		assert.NoError(t, store.storeRecord(record))
+	}
+	assert.NoError(t, store.Close())
+
+	store = NewStore(context.Background(), store.name, store.logger)
+	assert.NoError(t, store.Open(os.O_RDONLY))
+	defer store.Close()
+	for i := 0; i < 3; i++ {
+		record, err := store.Read()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i), record.GetHistory().GetStep().GetNum())
+	}
+	_, err := store.Read()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestStoreInvalidHeader(t *testing.T) {
+	store := makeStore(t)
+	assert.NoError(t, os.WriteFile(store.name, []byte("not a wandb file"), 0644))
+	assert.Error(t, store.Open(os.O_RDONLY))
+
+	// appending to it starts a new log and keeps the file aside
+	assert.NoError(t, store.Open(os.O_WRONLY|os.O_APPEND))
+	assert.NoError(t, store.storeRecord(&service.Record{RecordType: &service.Record_Exit{Exit: &service.RunExitRecord{}}}))
+	assert.NoError(t, store.Close())
+	aside, err := filepath.Glob(store.name + ".invalid-*")
+	assert.NoError(t, err)
+	assert.Len(t, aside, 1)
+	data, err := os.ReadFile(aside[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "not a wandb file", string(data))
+
+	store = NewStore(context.Background(), store.name, store.logger)
+	assert.NoError(t, store.Open(os.O_RDONLY))
+	defer store.Close()
+	record, err := store.Read()
+	assert.NoError(t, err)
+	assert.NotNil(t, record.GetExit())
+}
+
+func TestStoreAppendAfterTornTail(t *testing.T) {
+	historyRecord := func(step int64) *service.Record {
+		return &service.Record{
+			RecordType: &service.Record_History{
+				History: &service.HistoryRecord{Step: &service.HistoryStep{Num: step}},
+			},
+		}
+	}
+
+	store := makeStore(t)
+	assert.NoError(t, store.Open(os.O_WRONLY|os.O_APPEND))
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, store.storeRecord(historyRecord(int64(i))))
+	}
+	size := store.segmentSize
+	assert.NoError(t, store.Close())
+
+	// simulate a crash in the middle of writing a chunk
+	f, err := os.OpenFile(store.name, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0xde, 0xad, 0xbe, 0xef, 0x20, 0x00, 0x01, 0x02})
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	store = NewStore(context.Background(), store.name, store.logger)
+	assert.NoError(t, store.Open(os.O_WRONLY|os.O_APPEND))
+	// the size counts the same bytes as when the records were written
+	assert.Equal(t, size, store.segmentSize)
+	assert.NoError(t, store.storeRecord(historyRecord(3)))
+	assert.NoError(t, store.Close())
+
+	store = NewStore(context.Background(), store.name, store.logger)
+	assert.NoError(t, store.Open(os.O_RDONLY))
+	defer store.Close()
+	var steps []int64
+	for {
+		record, err := store.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		steps = append(steps, record.GetHistory().GetStep().GetNum())
+	}
+	assert.Equal(t, []int64{0, 1, 2, 3}, steps)
+}
+
+func TestStoreCompressedSegments(t *testing.T) {
+	for _, compression := range []Compression{CompressionNone, CompressionZstd, CompressionSnappy} {
+		t.Run(compression.String(), func(t *testing.T) {
+			store := makeStore(t)
+			store.SetOptions(StoreOptions{Compression: compression, MaxSegmentSize: 1024})
+			assert.NoError(t, store.Open(os.O_WRONLY))
+			num := 100
+			for i := 0; i < num; i++ {
+				record := &service.Record{
+					RecordType: &service.Record_OutputRaw{
+						OutputRaw: &service.OutputRawRecord{Line: fmt.Sprintf("line %d of some console output\n", i)},
+					},
+				}
+				assert.NoError(t, store.storeRecord(record))
+			}
+			assert.NoError(t, store.Close())
+			assert.Greater(t, store.segment, 0)
+
+			store = NewStore(context.Background(), store.name, store.logger)
+			assert.NoError(t, store.Open(os.O_RDONLY))
+			defer store.Close()
+			for i := 0; i < num; i++ {
+				record, err := store.Read()
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("line %d of some console output\n", i), record.GetOutputRaw().GetLine())
+			}
+			_, err := store.Read()
+			assert.ErrorIs(t, err, io.EOF)
+		})
+	}
+}
+
+func TestStoreEncrypted(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	store := makeStore(t)
+	store.SetOptions(StoreOptions{Compression: CompressionZstd, Key: key})
+	assert.NoError(t, store.Open(os.O_WRONLY))
+	record := &service.Record{
+		RecordType: &service.Record_OutputRaw{
+			OutputRaw: &service.OutputRawRecord{Line: "a secret line\n"},
+		},
+	}
+	assert.NoError(t, store.storeRecord(record))
+	assert.NoError(t, store.Close())
+
+	data, err := os.ReadFile(store.name)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "secret")
+
+	t.Setenv(storeKeyEnv, "")
+	reader := NewStore(context.Background(), store.name, store.logger)
+	assert.ErrorIs(t, reader.Open(os.O_RDONLY), ErrStoreKeyMissing)
+
+	reader = NewStore(context.Background(), store.name, store.logger)
+	reader.SetOptions(StoreOptions{Key: key})
+	assert.NoError(t, reader.Open(os.O_RDONLY))
+	defer reader.Close()
+	got, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "a secret line\n", got.GetOutputRaw().GetLine())
+}
+
+func TestStoreOptionsFromEnv(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	t.Setenv("WANDB_NEXUS_STORE_COMPRESSION", "bogus")
+	t.Setenv("WANDB_NEXUS_STORE_SEGMENT_SIZE", "1024")
+	t.Setenv(storeKeyEnv, base64.StdEncoding.EncodeToString(key))
+
+	// an invalid option doesn't keep the others from being parsed
+	options, err := StoreOptionsFromEnv()
+	assert.Error(t, err)
+	var keyErr *StoreKeyError
+	assert.False(t, errors.As(err, &keyErr))
+	assert.Equal(t, int64(1024), options.MaxSegmentSize)
+	assert.Equal(t, key, options.Key)
+
+	// an invalid key is told apart so the log is not written in plaintext
+	t.Setenv(storeKeyEnv, "not a key")
+	_, err = StoreOptionsFromEnv()
+	assert.True(t, errors.As(err, &keyErr))
+}
+
+func TestStoreReadOffset(t *testing.T) {
+	store := makeStore(t)
+	assert.NoError(t, store.Open(os.O_WRONLY))
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, store.storeRecord(&service.Record{RecordType: &service.Record_Exit{Exit: &service.RunExitRecord{ExitCode: int32(i)}}}))
+	}
+	assert.NoError(t, store.Close())
+
+	// corrupt the payload of the last record so that its checksum fails
+	data, err := os.ReadFile(store.name)
+	assert.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(store.name, data, 0644))
+
+	store = NewStore(context.Background(), store.name, store.logger)
+	assert.NoError(t, store.Open(os.O_RDONLY))
+	defer store.Close()
+	_, err = store.Read()
+	assert.NoError(t, err)
+	// the offset counts the chunk header of the record
+	first := store.Offset()
+	assert.Equal(t, int64(7+proto.Size(&service.Record{RecordType: &service.Record_Exit{Exit: &service.RunExitRecord{}}})), first)
+
+	_, err = store.Read()
+	var chunkErr *ChunkError
+	assert.ErrorAs(t, err, &chunkErr)
+}
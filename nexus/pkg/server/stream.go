@@ -101,8 +101,12 @@ func (s *Stream) Start() {
 	//  a pattern to handle multiple writers
 
 	handlerInChan := make(chan *service.Record, BufferSize)
+	// the sender publishes the progress of the run for the handler
+	s.sender = NewSender(s.ctx, s.settings, s.logger)
+
 	// handle the client requests
 	s.handler = NewHandler(s.ctx, s.settings, s.logger)
+	s.handler.runStatus = s.sender.status
 	s.wg.Add(1)
 	go func() {
 		s.handler.do(handlerInChan)
@@ -118,7 +122,6 @@ func (s *Stream) Start() {
 	}()
 
 	// send the data to the server
-	s.sender = NewSender(s.ctx, s.settings, s.logger)
 	s.wg.Add(1)
 	go func() {
 		s.sender.do(s.writer.recordChan)
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+// Syncer replays a transaction log written by the Store through a Sender,
+// uploading a run that was recorded offline to the server.
+type Syncer struct {
+	// ctx is the context for the syncer
+	ctx context.Context
+
+	// settings is the settings for the syncer, SyncFile is the log to replay
+	settings *service.Settings
+
+	// logger is the logger for the syncer
+	logger *observability.NexusLogger
+
+	// store is the transaction log being replayed
+	store *Store
+
+	// sender is the sender the records are replayed through
+	sender *Sender
+
+	// inChan is the channel for records going to the sender
+	inChan chan *service.Record
+
+	// pending are the records read before the run record
+	pending []*service.Record
+
+	// started is whether the run has been upserted and started
+	started bool
+
+	// exitRecord is held back until the whole log has been replayed
+	exitRecord *service.Record
+
+	wg sync.WaitGroup
+}
+
+// NewSyncer creates a new syncer
+func NewSyncer(ctx context.Context, settings *service.Settings, logger *observability.NexusLogger) *Syncer {
+	// the whole point of syncing is to talk to the server
+	settings.XOffline = &wrapperspb.BoolValue{Value: false}
+
+	syncer := &Syncer{
+		ctx:      ctx,
+		settings: settings,
+		logger:   logger,
+		inChan:   make(chan *service.Record, BufferSize),
+	}
+	return syncer
+}
+
+// Do replays the transaction log and waits until the sender has finished
+// uploading the run
+func (s *Syncer) Do() error {
+	s.logger.Info("syncer: started", "file", s.settings.GetSyncFile().GetValue())
+
+	s.store = NewStore(s.ctx, s.settings.GetSyncFile().GetValue(), s.logger)
+	if err := s.store.Open(os.O_RDONLY); err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.store.Close(); err != nil {
+			s.logger.CaptureError("syncer: error closing store", err)
+		}
+	}()
+
+	s.sender = NewSender(s.ctx, s.settings, s.logger)
+	// the files rebuilt from the log are written to their own dir, so the
+	// files the run wrote in the files dir are left as they are
+	filesDir, err := os.MkdirTemp(s.settings.GetTmpDir().GetValue(), "wandb-sync-files-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(filesDir)
+	s.sender.runFiles = newRunFiles(filesDir, s.logger)
+
+	s.wg.Add(1)
+	go func() {
+		s.sender.do(s.inChan)
+		s.wg.Done()
+	}()
+
+	for {
+		record, err := s.store.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// upload everything we can read, a torn block is expected
+			// if the process writing the log was killed
+			s.logger.CaptureError("syncer: error reading record", err)
+			s.store.Recover()
+			continue
+		}
+		if err = s.syncRecord(record); err != nil {
+			s.close()
+			return err
+		}
+	}
+
+	if !s.started {
+		s.close()
+		return fmt.Errorf("syncer: no run record found in %s", s.settings.GetSyncFile().GetValue())
+	}
+
+	if s.exitRecord == nil {
+		// the run never finished, so we mark it as failed
+		s.logger.Warn("syncer: no exit record found, marking run as failed")
+		s.exitRecord = &service.Record{
+			RecordType: &service.Record_Exit{Exit: &service.RunExitRecord{ExitCode: 1}},
+		}
+	}
+	// the exit record kicks off the sender's defer state machine which
+	// flushes the file stream and the uploader and then shuts down the sender
+	s.exitRecord.Control = &service.Control{AlwaysSend: true}
+	s.inChan <- s.exitRecord
+
+	s.wg.Wait()
+	s.logger.Info("syncer: finished", "file", s.settings.GetSyncFile().GetValue())
+	return nil
+}
+
+// syncRecord passes a record from the transaction log to the sender
+func (s *Syncer) syncRecord(record *service.Record) error {
+	switch record.RecordType.(type) {
+	case *service.Record_Run:
+		return s.syncRun(record)
+	case *service.Record_Exit:
+		// records flushed by the defer state machine are written after
+		// the exit record, so hold it back until the end of the log
+		s.exitRecord = record
+	case *service.Record_Request, nil:
+		// requests are never persisted, nothing to do
+	default:
+		if !s.started {
+			s.pending = append(s.pending, record)
+			return nil
+		}
+		s.inChan <- record
+	}
+	return nil
+}
+
+// syncRun upserts the run and starts the sender's file stream and uploader
+func (s *Syncer) syncRun(record *service.Record) error {
+	if s.started {
+		// later run records are updates to the run we already started
+		s.inChan <- record
+		return nil
+	}
+
+	run := record.GetRun()
+	if entity := s.settings.GetEntity().GetValue(); entity != "" {
+		run.Entity = entity
+	}
+	if project := s.settings.GetProject().GetValue(); project != "" {
+		run.Project = project
+	}
+	if s.settings.GetRunId() == nil {
+		s.settings.RunId = &wrapperspb.StringValue{Value: run.RunId}
+	}
+	if run.StartTime != nil {
+		startTime := float64(run.StartTime.AsTime().UnixMicro()) / 1e6
+		s.settings.XStartTime = &wrapperspb.DoubleValue{Value: startTime}
+	}
+
+	// we need the result of the upsert before we can stream anything
+	record.Control = &service.Control{ReqResp: true}
+	s.inChan <- record
+	result := <-s.sender.resultChan
+	if err := result.GetRunResult().GetError(); err != nil {
+		return fmt.Errorf("syncer: failed to upsert run: %s", err.GetMessage())
+	}
+
+	s.inChan <- &service.Record{
+		RecordType: &service.Record_Request{Request: &service.Request{
+			RequestType: &service.Request_RunStart{RunStart: &service.RunStartRequest{Run: run}},
+		}},
+	}
+	s.started = true
+
+	// the defer state machine goes through the sender's record channel,
+	// which in a stream is routed back to the sender through the handler
+	s.wg.Add(1)
+	go func() {
+		for rec := range s.sender.recordChan {
+			s.inChan <- rec
+		}
+		close(s.inChan)
+		s.wg.Done()
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		for result := range s.sender.resultChan {
+			s.logger.Debug("syncer: got result", "result", result)
+		}
+		s.wg.Done()
+	}()
+
+	for _, rec := range s.pending {
+		s.inChan <- rec
+	}
+	s.pending = nil
+	return nil
+}
+
+// close shuts down a sender that was never started, a started sender
+// is shut down by the defer state machine instead
+func (s *Syncer) close() {
+	close(s.inChan)
+	s.wg.Wait()
+}
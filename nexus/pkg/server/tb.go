@@ -0,0 +1,567 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+const (
+	// tbPollInterval is how often the log dirs are checked for new events
+	tbPollInterval = 2 * time.Second
+
+	// tbMaxHistogramBins is the most bins a wandb histogram can have
+	tbMaxHistogramBins = 512
+)
+
+// TBHandler follows the tensorboard event files in the log dirs of TBRecords
+// and turns their summaries into history, like sync_tensorboard does
+type TBHandler struct {
+	// filesDir is where media and saved event files are written
+	filesDir string
+
+	// logger is the logger for the tensorboard handler
+	logger *observability.NexusLogger
+
+	// watchers are the watchers of the log dirs
+	watchers []*tbWatcher
+
+	// recordChan is the channel for the records made from the events,
+	// to be handled by the handler
+	recordChan chan *service.Record
+
+	// done is closed to stop the watchers
+	done chan struct{}
+
+	// wg is the wait group for the watchers
+	wg sync.WaitGroup
+
+	// stopped is whether the watchers have been stopped
+	stopped bool
+}
+
+// NewTBHandler creates a new tensorboard handler
+func NewTBHandler(settings *service.Settings, logger *observability.NexusLogger) *TBHandler {
+	return &TBHandler{
+		filesDir:   settings.GetFilesDir().GetValue(),
+		logger:     logger,
+		recordChan: make(chan *service.Record, BufferSize),
+		done:       make(chan struct{}),
+	}
+}
+
+// Handle starts watching the log dir of a TBRecord
+func (tb *TBHandler) Handle(record *service.TBRecord) {
+	if tb.stopped {
+		return
+	}
+	for _, w := range tb.watchers {
+		if w.logDir == record.LogDir {
+			return
+		}
+	}
+	w := &tbWatcher{
+		logDir:   record.LogDir,
+		rootDir:  record.RootDir,
+		save:     record.Save,
+		filesDir: tb.filesDir,
+		logger:   tb.logger,
+		files:    make(map[string]*tbEventFile),
+	}
+	tb.watchers = append(tb.watchers, w)
+	tb.wg.Add(1)
+	go func() {
+		w.watch(tb.done, tb.recordChan)
+		tb.wg.Done()
+	}()
+	tb.logger.Info("tb: watching log dir", "log_dir", record.LogDir)
+}
+
+// Finish stops watching, reads the events left in the event files and returns
+// the records that have not been delivered yet, including the saved event files
+func (tb *TBHandler) Finish() []*service.Record {
+	if tb.stopped {
+		return nil
+	}
+	tb.stop()
+
+	var records []*service.Record
+	for len(tb.recordChan) > 0 {
+		records = append(records, <-tb.recordChan)
+	}
+	for _, w := range tb.watchers {
+		w.scan()
+		for _, f := range w.files {
+			w.flushRow(f)
+		}
+		records = append(records, w.pending...)
+		w.pending = nil
+		w.close()
+		if w.save {
+			if record := w.saveFiles(); record != nil {
+				records = append(records, record)
+			}
+		}
+	}
+	return records
+}
+
+// Close stops watching without reading the rest of the events
+func (tb *TBHandler) Close() {
+	if tb.stopped {
+		return
+	}
+	tb.stop()
+	for _, w := range tb.watchers {
+		w.close()
+	}
+}
+
+// stop stops the watchers, the event files stay open
+func (tb *TBHandler) stop() {
+	tb.stopped = true
+	close(tb.done)
+	tb.wg.Wait()
+}
+
+// tbWatcher follows the event files of a log dir
+type tbWatcher struct {
+	// logDir is the dir with the event files
+	logDir string
+
+	// rootDir is the dir the history keys are namespaced relative to
+	rootDir string
+
+	// save is whether to upload the event files
+	save bool
+
+	// filesDir is where media and saved event files are written
+	filesDir string
+
+	logger *observability.NexusLogger
+
+	// files are the event files found by path
+	files map[string]*tbEventFile
+
+	// pending are the records made from the events that are not delivered yet
+	pending []*service.Record
+}
+
+// tbEventFile is an event file being read
+type tbEventFile struct {
+	// path is the path of the file
+	path string
+
+	// namespace is the prefix of the history keys of the file
+	namespace string
+
+	// offset is where the next record starts
+	offset int64
+
+	// file is the open event file, it is read as it is written
+	file *os.File
+
+	// reader buffers the reads of the file
+	reader *bufio.Reader
+
+	// partial is the part of the next record that was written so far
+	partial []byte
+
+	// corrupt is set when the framing is broken, the rest is not read
+	corrupt bool
+
+	// row is the history row of the current step
+	row *tbRow
+}
+
+// tbRow is the history of a step of an event file
+type tbRow struct {
+	step     int64
+	wallTime float64
+	items    []*service.HistoryItem
+}
+
+func (w *tbWatcher) watch(done <-chan struct{}, recordChan chan<- *service.Record) {
+	ticker := time.NewTicker(tbPollInterval)
+	defer ticker.Stop()
+	for {
+		w.scan()
+		for len(w.pending) > 0 {
+			select {
+			case recordChan <- w.pending[0]:
+				w.pending = w.pending[1:]
+			case <-done:
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// scan reads the new events of the event files in the log dir
+func (w *tbWatcher) scan() {
+	err := filepath.WalkDir(w.logDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// the log dir may not have been created yet
+			return nil
+		}
+		if d.IsDir() || !strings.Contains(d.Name(), "tfevents") {
+			return nil
+		}
+		f, ok := w.files[path]
+		if !ok {
+			f = &tbEventFile{path: path, namespace: w.namespace(filepath.Dir(path))}
+			w.files[path] = f
+		}
+		w.readFile(f)
+		return nil
+	})
+	if err != nil {
+		w.logger.CaptureError("tb: error scanning log dir", err, "log_dir", w.logDir)
+	}
+}
+
+// close closes the event files of the log dir
+func (w *tbWatcher) close() {
+	for _, f := range w.files {
+		f.close()
+	}
+}
+
+// namespace returns the prefix of the history keys logged from dir,
+// which is its path relative to the root dir
+func (w *tbWatcher) namespace(dir string) string {
+	if w.rootDir == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(w.rootDir, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// readFile reads the records written to an event file since it was last
+// read, the file is kept open to continue where it stopped
+func (w *tbWatcher) readFile(f *tbEventFile) {
+	if f.corrupt {
+		return
+	}
+	if f.file == nil {
+		file, err := os.Open(f.path)
+		if err != nil {
+			w.logger.CaptureError("tb: error opening event file", err, "path", f.path)
+			return
+		}
+		f.file = file
+		f.reader = bufio.NewReader(file)
+	}
+
+	for {
+		record, n, err := f.next()
+		if err != nil {
+			w.logger.CaptureError("tb: stopped reading event file", err, "path", f.path, "offset", f.offset)
+			f.corrupt = true
+			f.close()
+			return
+		}
+		if n == 0 {
+			return
+		}
+		f.offset += int64(n)
+		if record == nil {
+			w.logger.CaptureWarn("tb: skipped corrupt event", "path", f.path, "offset", f.offset)
+			continue
+		}
+		event, err := parseTBEvent(record)
+		if err != nil {
+			w.logger.CaptureError("tb: error parsing event", err, "path", f.path)
+			continue
+		}
+		w.addEvent(f, event)
+	}
+}
+
+// next reads the next record of the file and returns its data and size. The
+// size is 0 if the record is not completely written yet, the part that is
+// is kept to be read with the rest.
+func (f *tbEventFile) next() ([]byte, int, error) {
+	if ok, err := f.fill(tfRecordHeaderSize); !ok {
+		return nil, 0, err
+	}
+	size, err := tfRecordSize(f.partial[:tfRecordHeaderSize])
+	if err != nil {
+		return nil, 0, err
+	}
+	if ok, err := f.fill(size); !ok {
+		return nil, 0, err
+	}
+	record, n, err := readTFRecord(f.partial)
+	f.partial = nil
+	return record, n, err
+}
+
+// fill reads until the partial record has size bytes, it returns false if
+// the file does not have them yet
+func (f *tbEventFile) fill(size int) (bool, error) {
+	start := len(f.partial)
+	if start >= size {
+		return true, nil
+	}
+	f.partial = append(f.partial, make([]byte, size-start)...)
+	n, err := io.ReadFull(f.reader, f.partial[start:])
+	f.partial = f.partial[:start+n]
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// close closes the event file
+func (f *tbEventFile) close() {
+	if f.file != nil {
+		_ = f.file.Close()
+		f.file = nil
+		f.reader = nil
+	}
+}
+
+// addEvent adds the values of an event to the row of its step, the row of
+// the previous step is complete once an event of a new step is read
+func (w *tbWatcher) addEvent(f *tbEventFile, event *tbEvent) {
+	if len(event.values) == 0 {
+		return
+	}
+	if f.row != nil && f.row.step != event.step {
+		w.flushRow(f)
+	}
+	if f.row == nil {
+		f.row = &tbRow{step: event.step}
+	}
+	f.row.wallTime = event.wallTime
+	for _, value := range event.values {
+		key := value.tag
+		if f.namespace != "" {
+			key = f.namespace + "/" + key
+		}
+		valueJson, ok := w.historyValue(key, event.step, value)
+		if !ok {
+			continue
+		}
+		f.row.items = append(f.row.items, &service.HistoryItem{Key: key, ValueJson: valueJson})
+	}
+}
+
+// flushRow adds the history of the current row to the pending records, it
+// is a row of its own rather than part of the row the run is logging
+func (w *tbWatcher) flushRow(f *tbEventFile) {
+	row := f.row
+	f.row = nil
+	if row == nil || len(row.items) == 0 {
+		return
+	}
+	items := append(row.items,
+		&service.HistoryItem{Key: "global_step", ValueJson: strconv.FormatInt(row.step, 10)},
+		&service.HistoryItem{Key: "_timestamp", ValueJson: jsonValue(row.wallTime)},
+	)
+	record := &service.Record{
+		RecordType: &service.Record_History{History: &service.HistoryRecord{Item: items}},
+	}
+	w.pending = append(w.pending, record)
+}
+
+// historyValue returns the history value (json) of a summary value
+func (w *tbWatcher) historyValue(key string, step int64, value *tbValue) (string, bool) {
+	switch {
+	case value.hasSimpleValue:
+		return jsonValue(value.simpleValue), true
+	case value.histogram != nil:
+		limits := value.histogram.bucketLimit
+		if len(limits) < 3 || len(limits) != len(value.histogram.bucket) {
+			return "", false
+		}
+		// the first and last buckets are unbounded, give them the width of their neighbours
+		first := limits[0] + limits[0] - limits[1]
+		last := limits[len(limits)-2] + limits[len(limits)-2] - limits[len(limits)-3]
+		bins := append(append([]float64{first}, limits[:len(limits)-1]...), last)
+		return w.histogramValue(key, value.histogram.bucket, bins)
+	case value.image != nil:
+		return w.imageValue(key, step, value.image)
+	case value.tensor != nil:
+		return w.tensorValue(key, step, value)
+	}
+	return "", false
+}
+
+// tensorValue returns the history value of a tensor summary, which is how
+// tensorflow 2 and pytorch write scalars, histograms and images
+func (w *tbWatcher) tensorValue(key string, step int64, value *tbValue) (string, bool) {
+	tensor := value.tensor
+	switch value.plugin {
+	case "images":
+		// the strings are the width, the height and the encoded images,
+		// only the first image is logged
+		if len(tensor.strings) < 3 {
+			return "", false
+		}
+		width, _ := strconv.ParseInt(string(tensor.strings[0]), 10, 64)
+		height, _ := strconv.ParseInt(string(tensor.strings[1]), 10, 64)
+		return w.imageValue(key, step, &tbImage{width: width, height: height, encoded: tensor.strings[2]})
+	case "histograms":
+		// the histogram is a k by 3 tensor of the left edge, the right edge and the count of each bucket
+		values, err := tensor.numbers()
+		if err != nil || len(values) == 0 || len(values)%3 != 0 {
+			return "", false
+		}
+		k := len(values) / 3
+		counts := make([]float64, k)
+		bins := make([]float64, k+1)
+		for i := 0; i < k; i++ {
+			bins[i] = values[3*i]
+			counts[i] = values[3*i+2]
+		}
+		bins[k] = values[3*k-2]
+		return w.histogramValue(key, counts, bins)
+	default:
+		values, err := tensor.numbers()
+		if err != nil || len(values) != 1 {
+			return "", false
+		}
+		return jsonValue(values[0]), true
+	}
+}
+
+func (w *tbWatcher) histogramValue(key string, counts []float64, bins []float64) (string, bool) {
+	if len(bins)-1 > tbMaxHistogramBins {
+		w.logger.CaptureWarn("tb: histogram has too many bins", "key", key, "bins", len(bins)-1)
+		return "", false
+	}
+	value, err := json.Marshal(map[string]interface{}{
+		"_type":  "histogram",
+		"values": counts,
+		"bins":   bins,
+	})
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+// imageValue writes an image to the media dir and returns the history value
+// referencing it, the image is uploaded with the files record it adds
+func (w *tbWatcher) imageValue(key string, step int64, image *tbImage) (string, bool) {
+	var format string
+	switch {
+	case bytes.HasPrefix(image.encoded, []byte("\x89PNG")):
+		format = "png"
+	case bytes.HasPrefix(image.encoded, []byte("\xff\xd8")):
+		format = "jpg"
+	case bytes.HasPrefix(image.encoded, []byte("GIF8")):
+		format = "gif"
+	default:
+		return "", false
+	}
+	if w.filesDir == "" {
+		return "", false
+	}
+
+	hash := sha256.Sum256(image.encoded)
+	sha := hex.EncodeToString(hash[:])
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(key)
+	path := filepath.Join("media", "images", name+"_"+strconv.FormatInt(step, 10)+"_"+sha[:20]+"."+format)
+	fullPath := filepath.Join(w.filesDir, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		w.logger.CaptureError("tb: error creating media dir", err)
+		return "", false
+	}
+	if err := os.WriteFile(fullPath, image.encoded, 0644); err != nil {
+		w.logger.CaptureError("tb: error writing image", err, "path", fullPath)
+		return "", false
+	}
+	w.pending = append(w.pending, filesRecord(service.FilesItem_NOW, path))
+
+	value, err := json.Marshal(map[string]interface{}{
+		"_type":  "image-file",
+		"path":   filepath.ToSlash(path),
+		"sha256": sha,
+		"size":   len(image.encoded),
+		"format": format,
+		"width":  image.width,
+		"height": image.height,
+	})
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+// saveFiles copies the event files to the files dir and returns the files
+// record to upload them
+func (w *tbWatcher) saveFiles() *service.Record {
+	baseDir := w.rootDir
+	if baseDir == "" {
+		baseDir = w.logDir
+	}
+	var paths []string
+	for _, f := range w.files {
+		rel, err := filepath.Rel(baseDir, f.path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = filepath.Base(f.path)
+		}
+		if err = copyFile(f.path, filepath.Join(w.filesDir, rel)); err != nil {
+			w.logger.CaptureError("tb: error saving event file", err, "path", f.path)
+			continue
+		}
+		paths = append(paths, rel)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return filesRecord(service.FilesItem_END, paths...)
+}
+
+func filesRecord(policy service.FilesItem_PolicyType, paths ...string) *service.Record {
+	files := &service.FilesRecord{}
+	for _, path := range paths {
+		files.Files = append(files.Files, &service.FilesItem{Path: path, Policy: policy})
+	}
+	return &service.Record{RecordType: &service.Record_Files{Files: files}}
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,439 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// tfevents files are TFRecord files of tensorflow.Event protos. Each record is
+// framed as:
+//
+//	uint64 length
+//	uint32 masked crc32c of length
+//	byte   data[length]
+//	uint32 masked crc32c of data
+//
+// The protos are decoded by hand to avoid depending on the tensorflow protos.
+const (
+	tfRecordHeaderSize = 12
+	tfRecordFooterSize = 4
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTFRecordCorrupt is returned when a record length fails its checksum,
+// after which the framing of the rest of the file can't be trusted
+var errTFRecordCorrupt = errors.New("tfrecord: corrupt record length")
+
+// maskedCRC is the crc32c masked the way TFRecord files store it
+func maskedCRC(data []byte) uint32 {
+	crc := crc32.Checksum(data, crc32cTable)
+	return ((crc >> 15) | (crc << 17)) + 0xa282ead8
+}
+
+// readTFRecord reads the record at the start of buf. It returns the record
+// data and the number of bytes it takes up in buf, which is 0 if buf does not
+// hold a whole record yet. A record whose data fails its checksum is skipped
+// by returning its size with a nil record.
+func readTFRecord(buf []byte) ([]byte, int, error) {
+	if len(buf) < tfRecordHeaderSize {
+		return nil, 0, nil
+	}
+	size, err := tfRecordSize(buf[:tfRecordHeaderSize])
+	if err != nil {
+		return nil, 0, err
+	}
+	if size > len(buf) {
+		return nil, 0, nil
+	}
+	end := size - tfRecordFooterSize
+	data := buf[tfRecordHeaderSize:end]
+	if maskedCRC(data) != binary.LittleEndian.Uint32(buf[end:end+tfRecordFooterSize]) {
+		return nil, end + tfRecordFooterSize, nil
+	}
+	return data, end + tfRecordFooterSize, nil
+}
+
+// tfRecordSize returns the size of a record, framing included, from its header
+func tfRecordSize(header []byte) (int, error) {
+	if maskedCRC(header[:8]) != binary.LittleEndian.Uint32(header[8:12]) {
+		return 0, errTFRecordCorrupt
+	}
+	length := binary.LittleEndian.Uint64(header[:8])
+	if length > math.MaxInt32 {
+		return 0, fmt.Errorf("tfrecord: record of %d bytes is too large", length)
+	}
+	return tfRecordHeaderSize + int(length) + tfRecordFooterSize, nil
+}
+
+// tbEvent is the part of a tensorflow.Event that is logged to the history
+type tbEvent struct {
+	wallTime float64
+	step     int64
+	values   []*tbValue
+}
+
+// tbValue is a tensorflow.Summary.Value, only one of the values is set
+type tbValue struct {
+	tag    string
+	plugin string
+
+	simpleValue    float64
+	hasSimpleValue bool
+
+	histogram *tbHistogram
+	image     *tbImage
+	tensor    *tbTensor
+}
+
+// tbHistogram is a tensorflow.HistogramProto, bucket i counts the values
+// between bucketLimit[i-1] and bucketLimit[i]
+type tbHistogram struct {
+	bucketLimit []float64
+	bucket      []float64
+}
+
+// tbImage is a tensorflow.Summary.Image
+type tbImage struct {
+	height  int64
+	width   int64
+	encoded []byte
+}
+
+// tensorflow.DataType values of the tensors we decode
+const (
+	tfFloat  = 1
+	tfDouble = 2
+	tfInt32  = 3
+	tfString = 7
+	tfInt64  = 9
+)
+
+// tbTensor is a tensorflow.TensorProto, the values are either in content
+// or in the typed value fields
+type tbTensor struct {
+	dtype   int
+	shape   []int64
+	content []byte
+	floats  []float64
+	ints    []int64
+	strings [][]byte
+}
+
+// consumeFields calls fn for each field of the message in b. fn returns the
+// number of bytes of the field value it consumed, or -1 to skip the field.
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = fn(num, typ, b)
+		if n == -1 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// consumeBytes consumes a length delimited field value into *v
+func consumeBytes(b []byte, v *[]byte) int {
+	value, n := protowire.ConsumeBytes(b)
+	*v = value
+	return n
+}
+
+// consumeVarint consumes a varint field value into *v
+func consumeVarint(b []byte, v *int64) int {
+	value, n := protowire.ConsumeVarint(b)
+	*v = int64(value)
+	return n
+}
+
+// consumeRepeated consumes a packed or unpacked repeated scalar field value,
+// calling add for each element
+func consumeRepeated(typ protowire.Type, b []byte, elemType protowire.Type, add func(v uint64)) int {
+	consume := func(b []byte) (uint64, int) {
+		switch elemType {
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			return uint64(v), n
+		case protowire.Fixed64Type:
+			return protowire.ConsumeFixed64(b)
+		default:
+			return protowire.ConsumeVarint(b)
+		}
+	}
+	if typ == elemType {
+		v, n := consume(b)
+		if n >= 0 {
+			add(v)
+		}
+		return n
+	}
+	if typ != protowire.BytesType {
+		return -1
+	}
+	packed, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n
+	}
+	for len(packed) > 0 {
+		v, m := consume(packed)
+		if m < 0 {
+			return m
+		}
+		add(v)
+		packed = packed[m:]
+	}
+	return n
+}
+
+func parseTBEvent(b []byte) (*tbEvent, error) {
+	event := &tbEvent{}
+	var summary []byte
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			event.wallTime = math.Float64frombits(v)
+			return n
+		case num == 2 && typ == protowire.VarintType:
+			return consumeVarint(b, &event.step)
+		case num == 5 && typ == protowire.BytesType:
+			return consumeBytes(b, &summary)
+		}
+		return -1
+	})
+	if err != nil || summary == nil {
+		return event, err
+	}
+	err = consumeFields(summary, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num != 1 || typ != protowire.BytesType {
+			return -1
+		}
+		var data []byte
+		n := consumeBytes(b, &data)
+		if n < 0 {
+			return n
+		}
+		value, err := parseTBValue(data)
+		if err != nil {
+			return -1
+		}
+		event.values = append(event.values, value)
+		return n
+	})
+	return event, err
+}
+
+func parseTBValue(b []byte) (*tbValue, error) {
+	value := &tbValue{}
+	var tag, metadata, histo, image, tensor []byte
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeBytes(b, &tag)
+		case num == 2 && typ == protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			value.simpleValue = float64(math.Float32frombits(v))
+			value.hasSimpleValue = true
+			return n
+		case num == 4 && typ == protowire.BytesType:
+			return consumeBytes(b, &image)
+		case num == 5 && typ == protowire.BytesType:
+			return consumeBytes(b, &histo)
+		case num == 8 && typ == protowire.BytesType:
+			return consumeBytes(b, &tensor)
+		case num == 9 && typ == protowire.BytesType:
+			return consumeBytes(b, &metadata)
+		}
+		return -1
+	})
+	if err != nil {
+		return nil, err
+	}
+	value.tag = string(tag)
+	if metadata != nil {
+		if value.plugin, err = parseTBPluginName(metadata); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case histo != nil:
+		value.histogram, err = parseTBHistogram(histo)
+	case image != nil:
+		value.image, err = parseTBImage(image)
+	case tensor != nil:
+		value.tensor, err = parseTBTensor(tensor)
+	}
+	return value, err
+}
+
+// parseTBPluginName returns the plugin name of a tensorflow.SummaryMetadata
+func parseTBPluginName(b []byte) (string, error) {
+	var pluginData, name []byte
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 && typ == protowire.BytesType {
+			return consumeBytes(b, &pluginData)
+		}
+		return -1
+	})
+	if err != nil || pluginData == nil {
+		return "", err
+	}
+	err = consumeFields(pluginData, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 && typ == protowire.BytesType {
+			return consumeBytes(b, &name)
+		}
+		return -1
+	})
+	return string(name), err
+}
+
+func parseTBHistogram(b []byte) (*tbHistogram, error) {
+	histogram := &tbHistogram{}
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 6:
+			return consumeRepeated(typ, b, protowire.Fixed64Type, func(v uint64) {
+				histogram.bucketLimit = append(histogram.bucketLimit, math.Float64frombits(v))
+			})
+		case 7:
+			return consumeRepeated(typ, b, protowire.Fixed64Type, func(v uint64) {
+				histogram.bucket = append(histogram.bucket, math.Float64frombits(v))
+			})
+		}
+		return -1
+	})
+	return histogram, err
+}
+
+func parseTBImage(b []byte) (*tbImage, error) {
+	image := &tbImage{}
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			return consumeVarint(b, &image.height)
+		case num == 2 && typ == protowire.VarintType:
+			return consumeVarint(b, &image.width)
+		case num == 4 && typ == protowire.BytesType:
+			return consumeBytes(b, &image.encoded)
+		}
+		return -1
+	})
+	return image, err
+}
+
+func parseTBTensor(b []byte) (*tbTensor, error) {
+	tensor := &tbTensor{}
+	var shape []byte
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			var dtype int64
+			n := consumeVarint(b, &dtype)
+			tensor.dtype = int(dtype)
+			return n
+		case 2:
+			return consumeBytes(b, &shape)
+		case 4:
+			return consumeBytes(b, &tensor.content)
+		case 5:
+			return consumeRepeated(typ, b, protowire.Fixed32Type, func(v uint64) {
+				tensor.floats = append(tensor.floats, float64(math.Float32frombits(uint32(v))))
+			})
+		case 6:
+			return consumeRepeated(typ, b, protowire.Fixed64Type, func(v uint64) {
+				tensor.floats = append(tensor.floats, math.Float64frombits(v))
+			})
+		case 7, 10:
+			return consumeRepeated(typ, b, protowire.VarintType, func(v uint64) {
+				tensor.ints = append(tensor.ints, int64(v))
+			})
+		case 8:
+			var s []byte
+			n := consumeBytes(b, &s)
+			tensor.strings = append(tensor.strings, s)
+			return n
+		}
+		return -1
+	})
+	if err != nil || shape == nil {
+		return tensor, err
+	}
+	// TensorShapeProto has repeated Dim dim = 2, each with int64 size = 1
+	err = consumeFields(shape, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num != 2 || typ != protowire.BytesType {
+			return -1
+		}
+		var dim []byte
+		n := consumeBytes(b, &dim)
+		if n < 0 {
+			return n
+		}
+		var size int64
+		if err := consumeFields(dim, func(num protowire.Number, typ protowire.Type, b []byte) int {
+			if num == 1 && typ == protowire.VarintType {
+				return consumeVarint(b, &size)
+			}
+			return -1
+		}); err != nil {
+			return -1
+		}
+		tensor.shape = append(tensor.shape, size)
+		return n
+	})
+	return tensor, err
+}
+
+// numbers returns the numeric values of the tensor
+func (t *tbTensor) numbers() ([]float64, error) {
+	if len(t.content) == 0 {
+		if len(t.floats) > 0 {
+			return t.floats, nil
+		}
+		values := make([]float64, len(t.ints))
+		for i, v := range t.ints {
+			values[i] = float64(v)
+		}
+		return values, nil
+	}
+	var size int
+	switch t.dtype {
+	case tfFloat, tfInt32:
+		size = 4
+	case tfDouble, tfInt64:
+		size = 8
+	default:
+		return nil, fmt.Errorf("tfrecord: unsupported tensor type %d", t.dtype)
+	}
+	if len(t.content)%size != 0 {
+		return nil, fmt.Errorf("tfrecord: invalid tensor content size %d", len(t.content))
+	}
+	values := make([]float64, len(t.content)/size)
+	for i := range values {
+		b := t.content[i*size:]
+		switch t.dtype {
+		case tfFloat:
+			values[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		case tfDouble:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		case tfInt32:
+			values[i] = float64(int32(binary.LittleEndian.Uint32(b)))
+		case tfInt64:
+			values[i] = float64(int64(binary.LittleEndian.Uint64(b)))
+		}
+	}
+	return values, nil
+}
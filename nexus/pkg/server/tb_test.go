@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// tfRecord frames an event the way tensorboard writes it
+func tfRecord(data []byte) []byte {
+	var b []byte
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, maskedCRC(b[:8]))
+	b = append(b, data...)
+	return binary.LittleEndian.AppendUint32(b, maskedCRC(data))
+}
+
+func tbEventBytes(step int64, values ...[]byte) []byte {
+	var summary []byte
+	for _, value := range values {
+		summary = protowire.AppendTag(summary, 1, protowire.BytesType)
+		summary = protowire.AppendBytes(summary, value)
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(1700000000))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(step))
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	return protowire.AppendBytes(b, summary)
+}
+
+func tbSimpleValue(tag string, value float32) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, tag)
+	b = protowire.AppendTag(b, 2, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, math.Float32bits(value))
+}
+
+// tbTensorScalar is a scalar the way tensorflow 2 writes it
+func tbTensorScalar(tag string, value float32) []byte {
+	var tensor []byte
+	tensor = protowire.AppendTag(tensor, 1, protowire.VarintType)
+	tensor = protowire.AppendVarint(tensor, tfFloat)
+	tensor = protowire.AppendTag(tensor, 4, protowire.BytesType)
+	tensor = protowire.AppendBytes(tensor, binary.LittleEndian.AppendUint32(nil, math.Float32bits(value)))
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, tag)
+	b = protowire.AppendTag(b, 8, protowire.BytesType)
+	return protowire.AppendBytes(b, tensor)
+}
+
+func tbHistogramValue(tag string, limits []float64, counts []float64) []byte {
+	var histo []byte
+	for num, values := range map[protowire.Number][]float64{6: limits, 7: counts} {
+		var packed []byte
+		for _, v := range values {
+			packed = protowire.AppendFixed64(packed, math.Float64bits(v))
+		}
+		histo = protowire.AppendTag(histo, num, protowire.BytesType)
+		histo = protowire.AppendBytes(histo, packed)
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, tag)
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	return protowire.AppendBytes(b, histo)
+}
+
+func TestTBHandler(t *testing.T) {
+	rootDir := t.TempDir()
+	logDir := filepath.Join(rootDir, "train")
+	filesDir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(logDir, 0755))
+
+	var data []byte
+	data = append(data, tfRecord(tbEventBytes(0))...) // the file version event has no summary
+	data = append(data, tfRecord(tbEventBytes(1, tbSimpleValue("loss", 0.5)))...)
+	data = append(data, tfRecord(tbEventBytes(1, tbTensorScalar("acc", 0.25)))...)
+	data = append(data, tfRecord(tbEventBytes(2, tbHistogramValue("w", []float64{0, 1, 2}, []float64{1, 2, 3})))...)
+	// a partially written event is read once it is complete
+	last := tfRecord(tbEventBytes(3, tbSimpleValue("loss", 0.125)))
+	data = append(data, last[:10]...)
+	eventFile := filepath.Join(logDir, "events.out.tfevents.1700000000.host")
+	assert.NoError(t, os.WriteFile(eventFile, data, 0644))
+
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	settings := &service.Settings{FilesDir: &wrapperspb.StringValue{Value: filesDir}}
+	tb := NewTBHandler(settings, logger)
+	tb.Handle(&service.TBRecord{LogDir: logDir, RootDir: rootDir, Save: true})
+
+	// the first step is complete once the second step is read
+	record := <-tb.recordChan
+	items := make(map[string]string)
+	for _, item := range record.GetHistory().GetItem() {
+		items[item.Key] = item.ValueJson
+	}
+	assert.Equal(t, "0.5", items["train/loss"])
+	assert.Equal(t, "0.25", items["train/acc"])
+	assert.Equal(t, "1", items["global_step"])
+
+	f, err := os.OpenFile(eventFile, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write(last[10:])
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	var rows []map[string]string
+	var files []string
+	for _, record := range tb.Finish() {
+		if history := record.GetHistory(); history != nil {
+			items := make(map[string]string)
+			for _, item := range history.Item {
+				items[item.Key] = item.ValueJson
+			}
+			rows = append(rows, items)
+		}
+		for _, file := range record.GetFiles().GetFiles() {
+			files = append(files, file.Path)
+		}
+	}
+	assert.Len(t, rows, 2)
+	assert.JSONEq(t, `{"_type": "histogram", "values": [1, 2, 3], "bins": [-1, 0, 1, 2]}`, rows[0]["train/w"])
+	assert.Equal(t, "0.125", rows[1]["train/loss"])
+	assert.Equal(t, "3", rows[1]["global_step"])
+
+	assert.Equal(t, []string{filepath.Join("train", "events.out.tfevents.1700000000.host")}, files)
+	saved, err := os.ReadFile(filepath.Join(filesDir, files[0]))
+	assert.NoError(t, err)
+	assert.Equal(t, append(data, last[10:]...), saved)
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+const (
+	// maxOutputLineLength is the length after which output lines are split
+	maxOutputLineLength = 60_000
+
+	// maxTerminalLines is how many lines the cursor can move back up to rewrite
+	maxTerminalLines = 64
+)
+
+// outputLine is a line of the console output, lines are numbered from the
+// start of the output so that rewritten lines replace what was sent before.
+// The output file of the run has the text as it was written, the file
+// stream sends it after the prefix.
+type outputLine struct {
+	num    int
+	text   string
+	prefix string
+}
+
+// streamText returns the text of the line as the file stream sends it
+func (line outputLine) streamText() string {
+	return line.prefix + line.text
+}
+
+// outputBuffer turns the raw console output of a run into lines. The stdout
+// and stderr are emulated separately and share the line numbers.
+type outputBuffer struct {
+	// terminals are the terminals of stdout and stderr
+	terminals map[service.OutputRawRecord_OutputType]*terminal
+
+	// nextLine is the number of the next new line
+	nextLine int
+}
+
+func newOutputBuffer() *outputBuffer {
+	return &outputBuffer{terminals: make(map[service.OutputRawRecord_OutputType]*terminal)}
+}
+
+// write adds raw output and returns the lines it finalized
+func (ob *outputBuffer) write(outputRaw *service.OutputRawRecord, t time.Time) []outputLine {
+	term, ok := ob.terminals[outputRaw.OutputType]
+	if !ok {
+		term = &terminal{outputType: outputRaw.OutputType}
+		ob.terminals[outputRaw.OutputType] = term
+	}
+	term.write(outputRaw.Line, t)
+	return term.flush(&ob.nextLine, false)
+}
+
+// flush returns all the lines not sent yet, including unfinished ones
+func (ob *outputBuffer) flush() []outputLine {
+	var lines []outputLine
+	for _, outputType := range []service.OutputRawRecord_OutputType{
+		service.OutputRawRecord_STDOUT,
+		service.OutputRawRecord_STDERR,
+	} {
+		if term, ok := ob.terminals[outputType]; ok {
+			lines = append(lines, term.flush(&ob.nextLine, true)...)
+		}
+	}
+	return lines
+}
+
+// terminal emulates enough of a terminal to handle progress bars: carriage
+// returns, backspaces and the ANSI sequences that move the cursor and erase.
+// Other escape sequences like colors are dropped.
+type terminal struct {
+	// outputType is whether this is stdout or stderr
+	outputType service.OutputRawRecord_OutputType
+
+	// lines are the lines the cursor can still move to, the last one is
+	// the bottom of the screen
+	lines []*terminalLine
+
+	// row and col are the position of the cursor in lines
+	row int
+	col int
+
+	// pending is an escape sequence or character split across writes
+	pending string
+
+	// now is the time of the current write
+	now time.Time
+}
+
+// terminalLine is a line on the terminal
+type terminalLine struct {
+	// runes are the characters of the line
+	runes []rune
+
+	// num is the line number in the output, -1 until it is sent
+	num int
+
+	// dirty is whether the line changed since it was sent
+	dirty bool
+
+	// time is when the line was last written
+	time time.Time
+}
+
+// line returns the line of the cursor, adding lines to reach it
+func (term *terminal) line() *terminalLine {
+	for len(term.lines) <= term.row {
+		term.lines = append(term.lines, &terminalLine{num: -1, time: term.now})
+	}
+	return term.lines[term.row]
+}
+
+func (term *terminal) write(text string, t time.Time) {
+	term.now = t
+	text = term.pending + text
+	term.pending = ""
+	for i := 0; i < len(text); {
+		if text[i] == '\x1b' {
+			n, complete := term.escape(text[i:])
+			if !complete {
+				term.pending = text[i:]
+				return
+			}
+			i += n
+			continue
+		}
+		if !utf8.FullRuneInString(text[i:]) {
+			term.pending = text[i:]
+			return
+		}
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if r == utf8.RuneError && size == 1 {
+			// bytes that are not utf-8 are written as their escape, the
+			// file stream sends json which would turn them into U+FFFD
+			for _, c := range fmt.Sprintf(`\x%02x`, text[i]) {
+				term.print(c)
+			}
+			i++
+			continue
+		}
+		i += size
+		switch r {
+		case '\r':
+			term.col = 0
+		case '\n':
+			term.newLine()
+		case '\b':
+			if term.col > 0 {
+				term.col--
+			}
+		default:
+			if r < ' ' && r != '\t' {
+				continue
+			}
+			term.print(r)
+		}
+	}
+}
+
+// print writes a character, long lines are split
+func (term *terminal) print(r rune) {
+	if term.col >= maxOutputLineLength {
+		term.newLine()
+	}
+	term.put(r)
+}
+
+// put writes a character at the cursor and moves it right
+func (term *terminal) put(r rune) {
+	line := term.line()
+	for len(line.runes) < term.col {
+		line.runes = append(line.runes, ' ')
+	}
+	if term.col < len(line.runes) {
+		line.runes[term.col] = r
+	} else {
+		line.runes = append(line.runes, r)
+	}
+	term.col++
+	line.dirty = true
+	line.time = term.now
+}
+
+func (term *terminal) newLine() {
+	term.line()
+	term.row++
+	term.col = 0
+	term.line()
+}
+
+// escape handles the escape sequence at the start of text, returning its
+// length and whether it is complete
+func (term *terminal) escape(text string) (int, bool) {
+	if len(text) < 2 {
+		return 0, false
+	}
+	if text[1] != '[' {
+		// not a control sequence, drop the escape and the next character
+		return 2, true
+	}
+	end := 2
+	for end < len(text) && (text[end] < 0x40 || text[end] > 0x7e) {
+		end++
+	}
+	if end == len(text) {
+		return 0, false
+	}
+	params := strings.Split(text[2:end], ";")
+	param := func(i int, def int) int {
+		if i >= len(params) || params[i] == "" {
+			return def
+		}
+		n, err := strconv.Atoi(params[i])
+		if err != nil {
+			return def
+		}
+		return n
+	}
+
+	switch text[end] {
+	case 'A': // cursor up
+		term.moveRow(-param(0, 1))
+	case 'B': // cursor down
+		term.moveRow(param(0, 1))
+	case 'C': // cursor forward
+		term.moveCol(term.col + param(0, 1))
+	case 'D': // cursor back
+		term.moveCol(term.col - param(0, 1))
+	case 'E': // cursor to the start of a next line
+		term.moveRow(param(0, 1))
+		term.col = 0
+	case 'F': // cursor to the start of a previous line
+		term.moveRow(-param(0, 1))
+		term.col = 0
+	case 'G': // cursor to column
+		term.moveCol(param(0, 1) - 1)
+	case 'K': // erase in line
+		term.eraseLine(term.line(), param(0, 0))
+	case 'J': // erase in display
+		mode := param(0, 0)
+		term.eraseLine(term.line(), mode)
+		for i, line := range term.lines {
+			if (mode == 0 && i > term.row) || (mode == 1 && i < term.row) || mode >= 2 {
+				term.eraseLine(line, 2)
+			}
+		}
+	}
+	return end + 1, true
+}
+
+// moveRow moves the cursor up or down, it stops at the first line it can
+// reach and at the last line, the bottom of the screen
+func (term *terminal) moveRow(n int) {
+	term.row += n
+	if last := len(term.lines) - 1; term.row > last {
+		term.row = last
+	}
+	if term.row < 0 {
+		term.row = 0
+	}
+}
+
+// moveCol moves the cursor to a column of the line
+func (term *terminal) moveCol(col int) {
+	switch {
+	case col < 0:
+		term.col = 0
+	case col > maxOutputLineLength:
+		term.col = maxOutputLineLength
+	default:
+		term.col = col
+	}
+}
+
+// eraseLine erases from the cursor to the end of the line (mode 0), from the
+// start of the line to the cursor (mode 1) or the whole line (mode 2)
+func (term *terminal) eraseLine(line *terminalLine, mode int) {
+	switch mode {
+	case 0:
+		if term.col < len(line.runes) {
+			line.runes = line.runes[:term.col]
+			line.dirty = true
+		}
+	case 1:
+		for i := 0; i <= term.col && i < len(line.runes); i++ {
+			line.runes[i] = ' '
+			line.dirty = true
+		}
+	default:
+		if len(line.runes) > 0 {
+			line.runes = line.runes[:0]
+			line.dirty = true
+		}
+	}
+}
+
+// flush returns the lines the cursor has moved past that are new or changed,
+// or all of them if all is set. Lines that can't be reached by the cursor
+// anymore are dropped.
+func (term *terminal) flush(nextLine *int, all bool) []outputLine {
+	end := term.row
+	if all {
+		end = len(term.lines)
+		// don't send the empty line the last newline started
+		for end > 0 && term.lines[end-1].num == -1 && len(term.lines[end-1].runes) == 0 {
+			end--
+		}
+	}
+	if end > len(term.lines) {
+		end = len(term.lines)
+	}
+
+	var lines []outputLine
+	for _, line := range term.lines[:end] {
+		if line.num == -1 {
+			line.num = *nextLine
+			*nextLine++
+		} else if !line.dirty {
+			continue
+		}
+		line.dirty = false
+		lines = append(lines, outputLine{
+			num:    line.num,
+			text:   string(line.runes),
+			prefix: outputLinePrefix(term.outputType, line.time),
+		})
+	}
+
+	drop := len(term.lines) - maxTerminalLines
+	if drop > term.row {
+		drop = term.row
+	}
+	if drop > 0 {
+		term.lines = term.lines[drop:]
+		term.row -= drop
+	}
+	return lines
+}
+
+// outputLinePrefix returns what the file stream sends before a line, the
+// time it was written and whether it is an error
+func outputLinePrefix(outputType service.OutputRawRecord_OutputType, t time.Time) string {
+	prefix := t.UTC().Format(time.RFC3339) + " "
+	if outputType == service.OutputRawRecord_STDERR {
+		prefix = "ERROR " + prefix
+	}
+	return prefix
+}
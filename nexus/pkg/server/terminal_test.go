@@ -0,0 +1,75 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+func TestOutputBuffer(t *testing.T) {
+	now := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	prefix := "2023-07-01T00:00:00Z "
+	ob := newOutputBuffer()
+	write := func(outputType service.OutputRawRecord_OutputType, text string) []outputLine {
+		return ob.write(&service.OutputRawRecord{OutputType: outputType, Line: text}, now)
+	}
+	stdout := service.OutputRawRecord_STDOUT
+
+	// a line is only sent once it ends, the newline can come in its own write
+	assert.Empty(t, write(stdout, "hello"))
+	assert.Equal(t, []outputLine{{0, "hello", prefix}}, write(stdout, "\n"))
+
+	// progress bars overwrite the line with carriage returns
+	assert.Empty(t, write(stdout, "  0%|          |"))
+	assert.Empty(t, write(stdout, "\r 50%|#####     |"))
+	assert.Equal(t, []outputLine{{1, "100%|##########|", prefix}}, write(stdout, "\r100%|##########|\n"))
+
+	// moving the cursor up rewrites lines that were already sent
+	assert.Equal(t, []outputLine{{2, "a", prefix}, {3, "b", prefix}}, write(stdout, "a\nb\n"))
+	// unchanged lines are not sent again
+	assert.Equal(t, []outputLine{{2, "c", prefix}}, write(stdout, "\x1b[2A\x1b[2K"+"c\n\x1b[1B"))
+
+	// escape sequences split across writes and colors
+	assert.Empty(t, write(stdout, "\x1b[3"))
+	assert.Equal(t, []outputLine{{4, "red", prefix}}, write(stdout, "1mred\x1b[0m\n"))
+
+	// stderr has its own cursor and shares the line numbers
+	assert.Empty(t, write(stdout, "unfinished"))
+	assert.Equal(t, []outputLine{{5, "oops", "ERROR " + prefix}}, write(service.OutputRawRecord_STDERR, "oops\n"))
+
+	// long lines are split
+	lines := write(stdout, strings.Repeat("x", maxOutputLineLength+10)+"\n")
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "unfinished"+strings.Repeat("x", maxOutputLineLength-len("unfinished")), lines[0].text)
+	assert.Equal(t, strings.Repeat("x", len("unfinished")+10), lines[1].text)
+
+	assert.Empty(t, write(stdout, "last"))
+	assert.Equal(t, []outputLine{{8, "last", prefix}}, ob.flush())
+}
+
+func TestOutputBufferInvalidUTF8(t *testing.T) {
+	now := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	ob := newOutputBuffer()
+	record := &service.OutputRawRecord{OutputType: service.OutputRawRecord_STDOUT, Line: "a\xffb\xc3\n"}
+
+	// bytes that are not utf-8 are kept as their escape rather than lost
+	assert.Equal(t, []outputLine{{0, "a\\xffb\\xc3", "2023-07-01T00:00:00Z "}}, ob.write(record, now))
+}
+
+func TestOutputBufferCursorDown(t *testing.T) {
+	now := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	prefix := "2023-07-01T00:00:00Z "
+	ob := newOutputBuffer()
+	write := func(text string) []outputLine {
+		return ob.write(&service.OutputRawRecord{OutputType: service.OutputRawRecord_STDOUT, Line: text}, now)
+	}
+
+	// the cursor stops at the bottom of the screen instead of adding lines
+	assert.Equal(t, []outputLine{{0, "a", prefix}}, write("a\n\x1b[99999999B"))
+	assert.Equal(t, []outputLine{{1, "b", prefix}}, write("b\x1b[99999999E\n"))
+	assert.Empty(t, ob.flush())
+	assert.Len(t, ob.terminals[service.OutputRawRecord_STDOUT].lines, 3)
+}
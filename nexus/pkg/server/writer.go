@@ -2,7 +2,10 @@ package server
 
 import (
 	"context"
+	"errors"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/wandb/wandb/nexus/pkg/observability"
 	"github.com/wandb/wandb/nexus/pkg/service"
@@ -31,6 +34,9 @@ type Writer struct {
 	// store is the store for the writer
 	store *Store
 
+	// policy decides when the store is committed to stable storage
+	policy DurabilityPolicy
+
 	wg sync.WaitGroup
 }
 
@@ -52,24 +58,33 @@ func (w *Writer) do(inChan <-chan *service.Record) {
 
 	w.storeChan = make(chan *service.Record, BufferSize*8)
 
-	var err error
-	w.store, err = NewStore(w.ctx, w.settings.GetSyncFile().GetValue(), nil)
+	w.store = NewStore(w.ctx, w.settings.GetSyncFile().GetValue(), w.logger)
+	options, err := StoreOptionsFromEnv()
+	var keyErr *StoreKeyError
+	if errors.As(err, &keyErr) {
+		// the log was meant to be encrypted, it is not written in plaintext
+		w.logger.CaptureFatalAndPanic("writer: can't use the store key", keyErr)
+	}
+	if err != nil {
+		w.logger.CaptureError("writer: invalid store options, using defaults for them", err)
+	}
+	w.store.SetOptions(options)
+	// append to the log if it already exists, so that a restarted run
+	// keeps the history written before it was interrupted
+	err = w.store.Open(os.O_WRONLY | os.O_APPEND)
 	if err != nil {
 		w.logger.CaptureFatalAndPanic("writer: error creating store", err)
 	}
 
+	w.policy, err = DurabilityPolicyFromEnv()
+	if err != nil {
+		w.logger.CaptureError("writer: invalid durability policy, using defaults", err)
+	}
+
 	w.wg = sync.WaitGroup{}
 	w.wg.Add(1)
 	go func() {
-		for record := range w.storeChan {
-			if err = w.store.storeRecord(record); err != nil {
-				w.logger.Error("writer: error storing record", "error", err)
-			}
-		}
-
-		if err = w.store.Close(); err != nil {
-			w.logger.CaptureError("writer: error closing store", err)
-		}
+		w.doStore()
 		w.wg.Done()
 	}()
 
@@ -79,6 +94,67 @@ func (w *Writer) do(inChan <-chan *service.Record) {
 	w.close()
 }
 
+// doStore stores the records in the append-only log and commits the log
+// to stable storage according to the durability policy
+func (w *Writer) doStore() {
+	// uncommitted is the number of records stored since the last commit
+	uncommitted := 0
+	var timer *time.Timer
+	var timerChan <-chan time.Time
+
+	store := func(record *service.Record) bool {
+		// requests are not persisted, they only mark commit points
+		if _, ok := record.RecordType.(*service.Record_Request); !ok {
+			if err := w.store.storeRecord(record); err != nil {
+				w.logger.Error("writer: error storing record", "error", err)
+			}
+			uncommitted++
+		}
+		return w.policy.isCommitPoint(record) || (w.policy.Records > 0 && uncommitted >= w.policy.Records)
+	}
+
+	for active := true; active; {
+		commit := false
+		select {
+		case record, ok := <-w.storeChan:
+			if !ok {
+				active = false
+				commit = w.policy.enabled() && uncommitted > 0
+				break
+			}
+			commit = store(record)
+			if w.policy.Interval > 0 && timerChan == nil && uncommitted > 0 {
+				timer = time.NewTimer(w.policy.Interval)
+				timerChan = timer.C
+			}
+		case <-timerChan:
+			timerChan = nil
+			commit = true
+		}
+		if !commit {
+			continue
+		}
+
+		// group commit: store the records that are already queued
+		// so that they share the cost of a single fsync
+		for n := len(w.storeChan); n > 0; n-- {
+			store(<-w.storeChan)
+		}
+		if err := w.store.Sync(); err != nil {
+			w.logger.CaptureError("writer: error committing store", err)
+		}
+		uncommitted = 0
+		if timer != nil {
+			timer.Stop()
+			timer, timerChan = nil, nil
+		}
+	}
+
+	if err := w.store.Close(); err != nil {
+		w.logger.CaptureError("writer: error closing store", err)
+	}
+}
+
 // close closes the writer and all its resources
 // which includes the store
 func (w *Writer) close() {
@@ -97,11 +173,17 @@ func (w *Writer) handleRecord(record *service.Record) {
 	switch record.RecordType.(type) {
 	case *service.Record_Request:
 		w.sendRecord(record)
+		if w.policy.isCommitPoint(record) {
+			w.storeRecord(record)
+		}
 	case nil:
 		w.logger.Error("nil record type")
 	default:
 		w.sendRecord(record)
-		w.storeRecord(record)
+		// local records are not persisted
+		if !record.GetControl().GetLocal() {
+			w.storeRecord(record)
+		}
 	}
 }
 
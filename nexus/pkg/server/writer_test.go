@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wandb/wandb/nexus/pkg/observability"
+	"github.com/wandb/wandb/nexus/pkg/service"
+)
+
+func TestParseDurabilityPolicy(t *testing.T) {
+	policy, err := ParseDurabilityPolicy("records:100,interval:250ms,exit")
+	assert.NoError(t, err)
+	assert.Equal(t, DurabilityPolicy{Records: 100, Interval: 250 * time.Millisecond, OnExit: true}, policy)
+
+	policy, err = ParseDurabilityPolicy("none")
+	assert.NoError(t, err)
+	assert.False(t, policy.enabled())
+
+	_, err = ParseDurabilityPolicy("records:zero")
+	assert.Error(t, err)
+	_, err = ParseDurabilityPolicy("always")
+	assert.Error(t, err)
+}
+
+func TestWriterCommitsOnExit(t *testing.T) {
+	logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+	fileName := filepath.Join(t.TempDir(), "test.wandb")
+	w := &Writer{
+		logger:    logger,
+		policy:    DurabilityPolicy{OnExit: true},
+		storeChan: make(chan *service.Record, BufferSize*8),
+		store:     NewStore(context.Background(), fileName, logger),
+	}
+	assert.NoError(t, w.store.Open(os.O_WRONLY))
+	done := make(chan struct{})
+	go func() {
+		w.doStore()
+		close(done)
+	}()
+	defer func() {
+		close(w.storeChan)
+		<-done
+	}()
+
+	w.storeChan <- &service.Record{RecordType: &service.Record_History{History: &service.HistoryRecord{}}}
+	w.storeChan <- &service.Record{RecordType: &service.Record_Exit{Exit: &service.RunExitRecord{}}}
+
+	// without closing the writer, both records have to reach the file
+	assert.Eventually(t, func() bool {
+		reader := NewStore(context.Background(), fileName, logger)
+		if err := reader.Open(os.O_RDONLY); err != nil {
+			return false
+		}
+		defer reader.Close()
+		n := 0
+		for {
+			if _, err := reader.Read(); err != nil {
+				break
+			}
+			n++
+		}
+		return n == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+// BenchmarkStoreDurability measures the cost of committing the log
+// to stable storage for each durability policy
+func BenchmarkStoreDurability(b *testing.B) {
+	policies := []string{"none", "exit", "records:1", "records:100", "interval:10ms"}
+	record := &service.Record{
+		RecordType: &service.Record_History{
+			History: &service.HistoryRecord{
+				Step: &service.HistoryStep{Num: 1},
+				Item: []*service.HistoryItem{
+					{Key: "loss", ValueJson: "0.123456"},
+					{Key: "accuracy", ValueJson: "0.987654"},
+				},
+			},
+		},
+	}
+	for _, p := range policies {
+		b.Run(p, func(b *testing.B) {
+			policy, err := ParseDurabilityPolicy(p)
+			assert.NoError(b, err)
+			logger := observability.NewNexusLogger(SetupDefaultLogger(), nil)
+			w := &Writer{
+				logger:    logger,
+				policy:    policy,
+				storeChan: make(chan *service.Record, BufferSize*8),
+				store:     NewStore(context.Background(), filepath.Join(b.TempDir(), "bench.wandb"), logger),
+			}
+			assert.NoError(b, w.store.Open(os.O_WRONLY))
+
+			done := make(chan struct{})
+			go func() {
+				w.doStore()
+				close(done)
+			}()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.storeChan <- record
+			}
+			close(w.storeChan)
+			<-done
+		})
+	}
+}